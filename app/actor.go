@@ -7,18 +7,63 @@ import (
 	"github.com/superisaac/jsoff/net"
 	"github.com/superisaac/jsoff/schema"
 	"github.com/superisaac/rpcmux/mq"
+	"net/http"
+	"strconv"
+	"time"
 )
 
 const (
 	declareSchema = `
 ---
 type: method
-description: declare serve methods, only callable via stream requests
+description: declare serve methods, only callable via stream requests, a method can be versioned by the name such as add@1.2.0
 params:
   - anyOf:
     - type: object
       properties: {}
     - type: "null"
+additionalParams:
+  type: object
+  name: options
+  description: declare options, such as per method timeouts, delivery modes and versions
+  properties:
+    methods:
+      type: object
+      properties: {}
+`
+	declareAddSchema = `
+---
+type: method
+description: add methods to the declared ones of the service, the options of other methods are kept
+params:
+  - type: object
+    name: methods
+    properties: {}
+additionalParams:
+  type: object
+  name: options
+  description: declare options of the added methods
+  properties:
+    methods:
+      type: object
+      properties: {}
+`
+	declareRemoveSchema = `
+---
+type: method
+description: remove methods from the declared ones of the service
+params:
+  - type: list
+    name: methods
+    items: string
+`
+	drainSchema = `
+---
+type: method
+description: stop choosing the service, the notify rpcmux.drained is sent to the worker once the pending requests complete
+params: []
+returns:
+  type: string
 `
 	showSchemaSchema = `
 ---
@@ -44,6 +89,194 @@ returns:
       type: list
       description: remote method names
       items: string
+    versions:
+      type: object
+      description: versions of methods served locally and remotely
+      properties: {}
+`
+	forwardSchema = `
+---
+type: method
+description: route a message forwarded from a peer node, only callable by nodes
+params:
+  - type: object
+    name: envelope
+    properties:
+      namespace:
+        type: string
+      method:
+        type: string
+      hops:
+        type: integer
+    requires: [namespace, method, hops]
+`
+	forwardCancelSchema = `
+---
+type: method
+description: cancel a request forwarded by a peer node over the same link, only callable by nodes
+params:
+  - type: string
+    name: id
+    description: id of the forwarded request
+`
+	listBreakersSchema = `
+---
+type: method
+description: list the circuit breakers of remote nodes, requires the admin role
+params: []
+returns:
+  type: list
+  items:
+    type: object
+    properties:
+      advertise_url:
+        type: string
+      state:
+        type: string
+        description: closed, open or half_open
+      changed_at:
+        type: integer
+        description: timestamp of the last state change
+      calls:
+        type: integer
+      failures:
+        type: integer
+`
+	listNodesSchema = `
+---
+type: method
+description: list the remote nodes known to the namespace, requires the admin role
+params: []
+returns:
+  type: list
+  items:
+    type: object
+    properties:
+      advertise_url:
+        type: string
+      update_at:
+        type: integer
+        description: timestamp of the last status
+      lease_expiry:
+        type: integer
+        description: timestamp when the node expires unless renewed
+      methods:
+        type: list
+        items: string
+      pending:
+        type: integer
+        description: requests in flight
+      breaker:
+        type: string
+        description: circuit breaker state
+      connected:
+        type: bool
+        description: whether the link to the node is connected
+`
+	listServicesSchema = `
+---
+type: method
+description: list the local services of the namespace, requires the admin role
+params: []
+returns:
+  type: list
+  items:
+    type: object
+    properties:
+      session_id:
+        type: string
+      remote_addr:
+        type: string
+      methods:
+        type: list
+        items: string
+      pending:
+        type: integer
+        description: requests in flight
+      connected_at:
+        type: integer
+        description: timestamp when the service declared first
+      labels:
+        type: object
+        properties: {}
+      weight:
+        type: integer
+      capacity:
+        type: integer
+        description: requests the service accepts at once, 0 is unlimited
+      rtt:
+        type: number
+        description: round trip time of the last ping in seconds
+      missed_pings:
+        type: integer
+        description: pings missed in a row
+`
+	showMetricsSchema = `
+---
+type: method
+description: show the metric counters of the namespace by name and method, requires the admin role
+params: []
+returns:
+  type: object
+  properties:
+    returns_violations:
+      type: object
+      description: results violating the returns schemas
+      properties: {}
+    shadow_requests:
+      type: object
+      description: requests mirrored to shadow services
+      properties: {}
+    shadow_mismatches:
+      type: object
+      description: shadow responses differing from the primary ones
+      properties: {}
+`
+	listConflictsSchema = `
+---
+type: method
+description: list the methods whose schemas differ across services and nodes, requires the admin role
+params: []
+returns:
+  type: list
+  items:
+    type: object
+    properties:
+      method:
+        type: string
+      schemas:
+        type: list
+        items:
+          type: object
+          properties:
+            hash:
+              type: string
+              description: digest of the schema
+            sessions:
+              type: list
+              description: local services declaring the schema
+              items: string
+            nodes:
+              type: list
+              description: remote nodes declaring the schema
+              items: string
+`
+	setSplitSchema = `
+---
+type: method
+description: set the weights splitting the traffic of a method between service groups, empty weights restore the configured split, requires the admin role
+params:
+  - type: string
+    name: method
+  - type: object
+    name: weights
+    description: relative weights by the label value, such as canary 5, stable 95
+    properties: {}
+additionalParams:
+  type: string
+  description: the label grouping services, track by default
+returns:
+  type: string
 `
 )
 
@@ -58,6 +291,124 @@ func extractNamespace(ctx context.Context) string {
 	return "default"
 }
 
+// requireAdmin checks the admin role in auth settings, servers
+// without auth are trusted
+func requireAdmin(ctx context.Context) error {
+	authinfo, ok := jsoffnet.AuthInfoFromContext(ctx)
+	if !ok || authinfo == nil {
+		return nil
+	}
+	if role, ok := authinfo.Settings["role"].(string); ok && role == "admin" {
+		return nil
+	}
+	return ErrAdminRequired
+}
+
+// httpRequest returns the http request beneath an rpc request, nil
+// for non http transports
+func httpRequest(req *jsoffnet.RPCRequest) (r *http.Request) {
+	defer func() {
+		if recover() != nil {
+			r = nil
+		}
+	}()
+	return req.HttpRequest()
+}
+
+// callerContext returns the context of a request, the deadline is
+// set if the caller sends a timeout via the X-Rpcmux-Timeout header,
+// either a duration such as 500ms or a number of seconds. The
+// X-Rpcmux-Hash-Key header makes the traffic split sticky and the
+// X-Rpcmux-Selector header selects services by labels.
+func callerContext(req *jsoffnet.RPCRequest) (context.Context, func()) {
+	ctx := req.Context()
+	if r := httpRequest(req); r != nil {
+		if h := r.Header.Get("X-Rpcmux-Hash-Key"); h != "" {
+			ctx = withHashKey(ctx, h)
+		}
+		if h := r.Header.Get("X-Rpcmux-Selector"); h != "" {
+			ctx = withSelectorText(ctx, h)
+		}
+		if h := r.Header.Get("X-Rpcmux-Timeout"); h != "" {
+			if timeout, err := parseTimeout(h); err == nil && timeout > 0 {
+				return context.WithTimeout(ctx, timeout)
+			} else {
+				req.Log().Warnf("bad timeout header %s", h)
+			}
+		}
+	}
+	return context.WithCancel(ctx)
+}
+
+func parseTimeout(v string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return time.ParseDuration(v)
+}
+
+// decodeDeclareParams decodes the methods and options of a declare,
+// returns the schemas and versioned names by method
+func decodeDeclareParams(params []interface{}) (map[string]jsoffschema.Schema, map[string]string, declareOptions, error) {
+	var opts declareOptions
+	var methods map[string]interface{}
+	if len(params) > 0 && params[0] != nil {
+		if err := jsoff.DecodeInterface(params[0], &methods); err != nil {
+			return nil, nil, opts, jsoff.ParamsError("bad methods")
+		}
+	}
+	if len(params) > 1 && params[1] != nil {
+		if err := jsoff.DecodeInterface(params[1], &opts); err != nil {
+			return nil, nil, opts, jsoff.ParamsError("bad declare options")
+		}
+	}
+
+	methodSchemas := map[string]jsoffschema.Schema{}
+	// methods declared by versioned names, such as add@1.2.0
+	names := map[string]string{}
+	for name, smap := range methods {
+		mname, vstr := splitVersion(name)
+		if !jsoff.IsPublicMethod(mname) {
+			continue
+		}
+		if _, ok := methodSchemas[mname]; ok {
+			return nil, nil, opts, jsoff.ParamsError(fmt.Sprintf("multiple versions of %s", mname))
+		}
+		if vstr != "" {
+			names[mname] = name
+			if opts.Methods == nil {
+				opts.Methods = map[string]declareMethodOptions{}
+			}
+			mopts := opts.Methods[name]
+			mopts.Version = vstr
+			delete(opts.Methods, name)
+			opts.Methods[mname] = mopts
+		}
+		if smap == nil {
+			methodSchemas[mname] = nil
+		} else {
+			builder := jsoffschema.NewSchemaBuilder()
+			s, err := builder.Build(smap)
+			if err != nil {
+				return nil, nil, opts, jsoff.ParamsError(fmt.Sprintf("schema of %s build failed", mname))
+			}
+			methodSchemas[mname] = s
+		}
+	}
+	return methodSchemas, names, opts, nil
+}
+
+// getDeclaringService returns the service of the declaring session
+func getDeclaringService(router *Router, req *jsoffnet.RPCRequest) *Service {
+	service, created := router.GetService(req.Session())
+	if created {
+		if r := httpRequest(req); r != nil {
+			service.remoteAddr = r.RemoteAddr
+		}
+	}
+	return service
+}
+
 func NewActor(apps ...*App) *jsoffnet.Actor {
 	var app *App
 	for _, a := range apps {
@@ -75,37 +426,137 @@ func NewActor(apps ...*App) *jsoffnet.Actor {
 	}
 
 	// declare methods
-	actor.OnTypedRequest("rpcmux.declare", func(req *jsoffnet.RPCRequest, methods map[string]interface{}) (string, error) {
+	actor.OnRequest("rpcmux.declare", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
 		session := req.Session()
 		if session == nil {
-			return "", jsoff.ErrMethodNotFound
+			return nil, jsoff.ErrMethodNotFound
 		}
+		methodSchemas, names, opts, err := decodeDeclareParams(params)
+		if err != nil {
+			return nil, err
+		}
+
 		ns := extractNamespace(req.Context())
 		router := app.GetRouter(ns)
-		service, _ := router.GetService(session)
+		service := getDeclaringService(router, req)
 
-		methodSchemas := map[string]jsoffschema.Schema{}
-		for mname, smap := range methods {
-			if !jsoff.IsPublicMethod(mname) {
-				continue
-			}
-			if smap == nil {
-				methodSchemas[mname] = nil
-			} else {
-				builder := jsoffschema.NewSchemaBuilder()
-				s, err := builder.Build(smap)
-				if err != nil {
-					return "", jsoff.ParamsError(fmt.Sprintf("schema of %s build failed", mname))
+		// nothing is applied unless the declaration is accepted
+		_, _, versions, err := parseMethodOptions(opts.Methods)
+		if err != nil {
+			return nil, err
+		}
+		if err := router.checkSchemaConflicts(service, methodSchemas, versions); err != nil {
+			return nil, err
+		}
+		if err := service.UpdateOptions(opts, names); err != nil {
+			return nil, err
+		}
+		err = service.UpdateMethods(methodSchemas)
+		if err != nil {
+			return nil, err
+		}
+		return "ok", nil
+	}, jsoffnet.WithSchemaYaml(declareSchema))
+
+	// add methods to the declared ones
+	actor.OnRequest("rpcmux.declare_add", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		session := req.Session()
+		if session == nil {
+			return nil, jsoff.ErrMethodNotFound
+		}
+		methodSchemas, names, opts, err := decodeDeclareParams(params)
+		if err != nil {
+			return nil, err
+		}
+
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		service := getDeclaringService(router, req)
+
+		// nothing is applied unless the declaration is accepted,
+		// methods added without options keep their versions
+		_, _, versions, err := parseMethodOptions(opts.Methods)
+		if err != nil {
+			return nil, err
+		}
+		for mname := range methodSchemas {
+			if _, ok := opts.Methods[mname]; !ok {
+				if v, ok := service.Version(mname); ok {
+					versions[mname] = v
 				}
-				methodSchemas[mname] = s
 			}
 		}
-		err := service.UpdateMethods(methodSchemas)
+		if err := router.checkSchemaConflicts(service, methodSchemas, versions); err != nil {
+			return nil, err
+		}
+		if err := service.AddOptions(opts, names); err != nil {
+			return nil, err
+		}
+		newMethods := map[string]jsoffschema.Schema{}
+		for mname, s := range service.Methods() {
+			newMethods[mname] = s
+		}
+		for mname, s := range methodSchemas {
+			newMethods[mname] = s
+		}
+		err = service.UpdateMethods(newMethods)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		return "ok", nil
-	}, jsoffnet.WithSchemaYaml(declareSchema))
+	}, jsoffnet.WithSchemaYaml(declareAddSchema))
+
+	// remove methods from the declared ones
+	actor.OnRequest("rpcmux.declare_remove", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		session := req.Session()
+		if session == nil {
+			return nil, jsoff.ErrMethodNotFound
+		}
+		var names []string
+		if err := jsoff.DecodeInterface(params[0], &names); err != nil {
+			return nil, jsoff.ParamsError("bad methods")
+		}
+
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		service := getDeclaringService(router, req)
+
+		mnames := []string{}
+		for _, name := range names {
+			mname, _ := splitVersion(name)
+			mnames = append(mnames, mname)
+		}
+		newMethods := map[string]jsoffschema.Schema{}
+		for mname, s := range service.Methods() {
+			if !stringInList(mname, mnames) {
+				newMethods[mname] = s
+			}
+		}
+		err := service.UpdateMethods(newMethods)
+		if err != nil {
+			return nil, err
+		}
+		service.RemoveOptions(mnames)
+		return "ok", nil
+	}, jsoffnet.WithSchemaYaml(declareRemoveSchema))
+
+	// stop choosing the service, rpcmux.drained is sent to the
+	// worker once the pending requests complete
+	actor.OnRequest("rpcmux.drain", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		session := req.Session()
+		if session == nil {
+			return nil, jsoff.ErrMethodNotFound
+		}
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		v, ok := router.serviceIndex.Load(session.SessionID())
+		if !ok {
+			return nil, jsoff.ParamsError("service not declared")
+		}
+		service, _ := v.(*Service)
+		router.DrainService(service)
+		return "ok", nil
+	}, jsoffnet.WithSchemaYaml(drainSchema))
 
 	// list the methods the current node can provide, the remote methods are also listed
 	actor.OnRequest("rpcmux.methods", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
@@ -117,12 +568,99 @@ func NewActor(apps ...*App) *jsoffnet.Actor {
 		remote_methods := router.RemoteMethods()
 
 		r := map[string]interface{}{
-			"methods": methods,
-			"remotes": remote_methods,
+			"methods":  methods,
+			"remotes":  remote_methods,
+			"versions": router.AllVersions(),
 		}
 		return r, nil
 	}, jsoffnet.WithSchemaYaml(listMethodsSchema))
 
+	// messages forwarded from peer nodes
+	actor.OnRequest("rpcmux.forward", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		return app.handleForward(req, params)
+	}, jsoffnet.WithSchemaYaml(forwardSchema))
+
+	// cancel a request forwarded from a peer node
+	actor.OnRequest("rpcmux.forward_cancel", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		return app.cancelForward(req, params)
+	}, jsoffnet.WithSchemaYaml(forwardCancelSchema))
+
+	// list the circuit breakers of remote nodes
+	actor.OnRequest("rpcmux.breakers", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		if err := requireAdmin(req.Context()); err != nil {
+			return nil, err
+		}
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		return router.BreakerStatus(), nil
+	}, jsoffnet.WithSchemaYaml(listBreakersSchema))
+
+	// list the remote nodes
+	actor.OnRequest("rpcmux.nodes", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		if err := requireAdmin(req.Context()); err != nil {
+			return nil, err
+		}
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		return router.NodesInfo(), nil
+	}, jsoffnet.WithSchemaYaml(listNodesSchema))
+
+	// list the local services
+	actor.OnRequest("rpcmux.services", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		if err := requireAdmin(req.Context()); err != nil {
+			return nil, err
+		}
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		return router.ServicesInfo(), nil
+	}, jsoffnet.WithSchemaYaml(listServicesSchema))
+
+	// show the metric counters
+	actor.OnRequest("rpcmux.metrics", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		if err := requireAdmin(req.Context()); err != nil {
+			return nil, err
+		}
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		return router.metrics.Snapshot(), nil
+	}, jsoffnet.WithSchemaYaml(showMetricsSchema))
+
+	// list the schema conflicts
+	actor.OnRequest("rpcmux.conflicts", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		if err := requireAdmin(req.Context()); err != nil {
+			return nil, err
+		}
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		return router.Conflicts(), nil
+	}, jsoffnet.WithSchemaYaml(listConflictsSchema))
+
+	// split the traffic of a method
+	actor.OnRequest("rpcmux.split", func(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+		if err := requireAdmin(req.Context()); err != nil {
+			return nil, err
+		}
+		ns := extractNamespace(req.Context())
+		router := app.GetRouter(ns)
+		method, _ := params[0].(string)
+		split := &SplitConfig{}
+		if err := jsoff.DecodeInterface(params[1], &split.Weights); err != nil {
+			return nil, jsoff.ParamsError("bad weights")
+		}
+		if len(split.Weights) == 0 {
+			router.SetSplit(method, nil)
+			return "ok", nil
+		}
+		if len(params) > 2 {
+			split.Label, _ = params[2].(string)
+		}
+		if err := split.validateValues(); err != nil {
+			return nil, jsoff.ParamsError(err.Error())
+		}
+		router.SetSplit(method, split)
+		return "ok", nil
+	}, jsoffnet.WithSchemaYaml(setSplitSchema))
+
 	actor.OnTypedRequest("rpcmux.schema", func(req *jsoffnet.RPCRequest, method string) (map[string]interface{}, error) {
 		// from actor
 		if actor.Has(method) {
@@ -133,11 +671,16 @@ func NewActor(apps ...*App) *jsoffnet.Actor {
 			}
 		}
 
-		// get schema from router
+		// get schema from router, the primary one unless the
+		// method names the schema hash
 		ns := extractNamespace(req.Context())
 		router := app.GetRouter(ns)
-		if srv, ok := router.SelectService(method); ok {
-			if schema, ok := srv.GetSchema(method); ok {
+		mname, h := splitSchemaHash(method)
+		if h == "" {
+			h = router.primarySchemaHash(mname, nil)
+		}
+		if srv, ok := router.selectService(mname, &selectCriteria{schema: h}); ok {
+			if schema, ok := srv.GetSchema(mname); ok {
 				return schema.Map(), nil
 			} else {
 				return nil, jsoff.ParamsError("no schema")
@@ -152,7 +695,9 @@ func NewActor(apps ...*App) *jsoffnet.Actor {
 		ns := extractNamespace(req.Context())
 
 		router := app.GetRouter(ns)
-		return router.Feed(msg)
+		ctx, cancel := callerContext(req)
+		defer cancel()
+		return router.Feed(ctx, msg)
 	})
 
 	actor.OnClose(func(session jsoffnet.RPCSession) {
@@ -0,0 +1,36 @@
+package app
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jsoff/net"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	assert := assert.New(t)
+
+	// servers without auth trust the callers
+	assert.Nil(requireAdmin(context.Background()))
+
+	admin := &jsoffnet.AuthInfo{
+		Username: "admin",
+		Settings: map[string]interface{}{"role": "admin"},
+	}
+	ctx := withAuthInfo(context.Background(), admin)
+	assert.Nil(requireAdmin(ctx))
+
+	guest := &jsoffnet.AuthInfo{Username: "guest"}
+	ctx = withAuthInfo(context.Background(), guest)
+	assert.Equal(ErrAdminRequired, requireAdmin(ctx))
+}
+
+func TestWithAuthInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	// the forwarded identity must be seen by jsoffnet
+	authinfo := &jsoffnet.AuthInfo{Username: "user1"}
+	found, ok := jsoffnet.AuthInfoFromContext(withAuthInfo(context.Background(), authinfo))
+	assert.True(ok)
+	assert.Equal(authinfo, found)
+}
@@ -0,0 +1,289 @@
+package app
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// balance strategies
+const (
+	BalanceRandom       = "random"
+	BalanceRoundRobin   = "round_robin"
+	BalanceLeastPending = "least_pending"
+	BalanceWeighted     = "weighted"
+	BalancePowerOfTwo   = "p2c"
+)
+
+// BalanceTarget is a candidate a balancer can choose, both *Service
+// and *RemoteService are balance targets
+type BalanceTarget interface {
+	// number of requests in flight
+	Pending() int64
+
+	// relative weight, used by weighted strategies
+	Weight() int
+}
+
+// Balancer chooses one of the targets serving a method, Select
+// returns the index of the chosen target, targets is never empty
+type Balancer interface {
+	Select(targets []BalanceTarget) int
+}
+
+// selectCriteria narrows the candidates of a selection, a nil
+// criteria accepts all candidates
+type selectCriteria struct {
+	// targets already tried
+	tried map[BalanceTarget]bool
+
+	// versions of the method wanted
+	version *VersionConstraint
+
+	// makes the split decisions sticky
+	hashKey string
+
+	// labels of services wanted
+	selector *LabelSelector
+
+	// schema hash of the method wanted
+	schema string
+}
+
+func (self *selectCriteria) getHashKey() string {
+	if self == nil {
+		return ""
+	}
+	return self.hashKey
+}
+
+func (self *selectCriteria) accept(method string, t BalanceTarget) bool {
+	if srv, ok := t.(*Service); ok && srv.Draining() {
+		return false
+	}
+	if self == nil {
+		return true
+	}
+	if self.tried[t] {
+		return false
+	}
+	if self.version != nil {
+		switch target := t.(type) {
+		case *Service:
+			if v, ok := target.Version(method); !ok || !self.version.Match(v) {
+				return false
+			}
+		case *RemoteService:
+			matched := false
+			for _, vstr := range target.Versions[method] {
+				if v, err := ParseVersion(vstr); err == nil && self.version.Match(v) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+	if self.schema != "" {
+		switch target := t.(type) {
+		// methods without schema conflict with nothing
+		case *Service:
+			if h := target.SchemaHash(method); h != "" && h != self.schema {
+				return false
+			}
+		case *RemoteService:
+			if hs := target.Schemas[method]; len(hs) > 0 && !stringInList(self.schema, hs) {
+				return false
+			}
+		}
+	}
+	if self.selector != nil {
+		switch target := t.(type) {
+		case *Service:
+			return self.selector.Match(target.Labels())
+		case *RemoteService:
+			// any service of the node serving the method matches
+			for _, summary := range target.Services {
+				if stringInList(method, summary.Methods) && self.selector.Match(summary.Labels) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// labelWeight is a weight configured for the services matching a
+// label selector
+type labelWeight struct {
+	selector *LabelSelector
+	weight   int
+}
+
+// weightedTarget is a target with the weight resolved for a method
+type weightedTarget struct {
+	BalanceTarget
+	weight int
+}
+
+func (self weightedTarget) Weight() int {
+	return self.weight
+}
+
+// configuredWeights returns the weights of a method configured by
+// label selectors, in the configured order
+func (self *Router) configuredWeights(method string) []labelWeight {
+	mcfg := lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) *MethodConfig {
+		if len(m.Weights) > 0 {
+			return m
+		}
+		return nil
+	})
+	if mcfg == nil {
+		return nil
+	}
+	weights := []labelWeight{}
+	for _, wcfg := range mcfg.Weights {
+		// selectors are checked when the config loads
+		if selector, err := ParseLabelSelector(wcfg.Selector); err == nil {
+			weights = append(weights, labelWeight{selector, wcfg.Weight})
+		}
+	}
+	return weights
+}
+
+// weightByLabels returns the weight of the first selector matching
+// the labels, or the declared weight if none matches
+func weightByLabels(weights []labelWeight, labels map[string]string, declared int) int {
+	for _, lw := range weights {
+		if lw.selector.Match(labels) {
+			return lw.weight
+		}
+	}
+	return declared
+}
+
+func NewBalancer(strategy string) (Balancer, error) {
+	switch strategy {
+	case "", BalanceRandom:
+		return &randomBalancer{}, nil
+	case BalanceRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case BalanceLeastPending:
+		return &leastPendingBalancer{}, nil
+	case BalanceWeighted:
+		return &weightedBalancer{}, nil
+	case BalancePowerOfTwo:
+		return &powerOfTwoBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown balance strategy %s", strategy)
+	}
+}
+
+// random
+type randomBalancer struct{}
+
+func (self randomBalancer) Select(targets []BalanceTarget) int {
+	return rand.Intn(len(targets))
+}
+
+// round robin
+type roundRobinBalancer struct {
+	counter uint64
+}
+
+func (self *roundRobinBalancer) Select(targets []BalanceTarget) int {
+	n := atomic.AddUint64(&self.counter, 1)
+	return int((n - 1) % uint64(len(targets)))
+}
+
+// least pending, ties are broken randomly
+type leastPendingBalancer struct{}
+
+func (self leastPendingBalancer) Select(targets []BalanceTarget) int {
+	found := -1
+	var least int64
+	ties := 0
+	for i, t := range targets {
+		p := t.Pending()
+		if found < 0 || p < least {
+			found = i
+			least = p
+			ties = 1
+		} else if p == least {
+			// reservoir sampling among the ties
+			ties++
+			if rand.Intn(ties) == 0 {
+				found = i
+			}
+		}
+	}
+	return found
+}
+
+// weighted random
+type weightedBalancer struct{}
+
+func (self weightedBalancer) Select(targets []BalanceTarget) int {
+	total := 0
+	for _, t := range targets {
+		if w := t.Weight(); w > 0 {
+			total += w
+		}
+	}
+	if total <= 0 {
+		return rand.Intn(len(targets))
+	}
+	r := rand.Intn(total)
+	for i, t := range targets {
+		if w := t.Weight(); w > 0 {
+			if r < w {
+				return i
+			}
+			r -= w
+		}
+	}
+	return len(targets) - 1
+}
+
+// power of two choices, pick two targets randomly and choose the one
+// with less requests in flight
+type powerOfTwoBalancer struct{}
+
+func (self powerOfTwoBalancer) Select(targets []BalanceTarget) int {
+	if len(targets) == 1 {
+		return 0
+	}
+	a := rand.Intn(len(targets))
+	b := rand.Intn(len(targets) - 1)
+	if b >= a {
+		b++
+	}
+	if targets[b].Pending() < targets[a].Pending() {
+		return b
+	}
+	return a
+}
+
+// router methods related to balancers
+func (self *Router) balancer(scope string, method string) Balancer {
+	key := scope + ":" + method
+	if v, ok := self.balancers.Load(key); ok {
+		b, _ := v.(Balancer)
+		return b
+	}
+	strategy := lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) string {
+		return m.Balance
+	})
+	b, err := NewBalancer(strategy)
+	if err != nil {
+		self.Log().Warnf("bad balance strategy of %s, %s, fallback to random", method, err)
+		b = &randomBalancer{}
+	}
+	v, _ := self.balancers.LoadOrStore(key, b)
+	b, _ = v.(Balancer)
+	return b
+}
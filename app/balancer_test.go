@@ -0,0 +1,173 @@
+package app
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type fakeTarget struct {
+	pending int64
+	weight  int
+}
+
+func (self fakeTarget) Pending() int64 {
+	return self.pending
+}
+
+func (self fakeTarget) Weight() int {
+	return self.weight
+}
+
+func TestBalancers(t *testing.T) {
+	assert := assert.New(t)
+
+	targets := []BalanceTarget{
+		fakeTarget{pending: 3, weight: 0},
+		fakeTarget{pending: 1, weight: 5},
+		fakeTarget{pending: 2, weight: 0},
+	}
+
+	rr, err := NewBalancer(BalanceRoundRobin)
+	assert.Nil(err)
+	assert.Equal(0, rr.Select(targets))
+	assert.Equal(1, rr.Select(targets))
+	assert.Equal(2, rr.Select(targets))
+	assert.Equal(0, rr.Select(targets))
+
+	lp, err := NewBalancer(BalanceLeastPending)
+	assert.Nil(err)
+	assert.Equal(1, lp.Select(targets))
+
+	w, err := NewBalancer(BalanceWeighted)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Equal(1, w.Select(targets))
+	}
+
+	p2c, err := NewBalancer(BalancePowerOfTwo)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		// the target with most pendings never wins
+		assert.NotEqual(0, p2c.Select(targets[:2]))
+	}
+
+	_, err = NewBalancer("bad")
+	assert.NotNil(err)
+}
+
+func TestBalanceConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgdata := `
+---
+router:
+  balance: round_robin
+  timeout: 5s
+  methods:
+    heavy:
+      balance: least_pending
+      timeout: 2m
+namespaces:
+  eastasia:
+    balance: p2c
+`
+	appcfg := &AppConfig{}
+	err := appcfg.LoadYamldata([]byte(cfgdata))
+	assert.Nil(err)
+
+	pick := func(m *MethodConfig) string { return m.Balance }
+	assert.Equal("round_robin", lookupMethodSetting(appcfg, "default", "echo", pick))
+	assert.Equal("least_pending", lookupMethodSetting(appcfg, "default", "heavy", pick))
+	assert.Equal("p2c", lookupMethodSetting(appcfg, "eastasia", "echo", pick))
+	assert.Equal("least_pending", lookupMethodSetting(appcfg, "eastasia", "heavy", pick))
+	assert.Equal(5*time.Second, appcfg.Router.Timeout)
+	assert.Equal(2*time.Minute, appcfg.Router.Methods["heavy"].Timeout)
+
+	err = appcfg.LoadYamldata([]byte("router:\n  balance: bad\n"))
+	assert.NotNil(err)
+}
+
+func TestSpareCandidates(t *testing.T) {
+	assert := assert.New(t)
+
+	full := NewService(nil, nil)
+	assert.Nil(full.UpdateOptions(declareOptions{Metadata: serviceMetadata{Capacity: 2}}, nil))
+	full.pending = 2
+
+	spare := NewService(nil, nil)
+	assert.Nil(spare.UpdateOptions(declareOptions{Metadata: serviceMetadata{Capacity: 2}}, nil))
+	spare.pending = 1
+
+	unlimited := NewService(nil, nil)
+	unlimited.pending = 100
+
+	assert.Equal([]*Service{spare, unlimited}, spareCandidates([]*Service{full, spare, unlimited}))
+
+	// all services are kept when every one is full
+	assert.Equal([]*Service{full}, spareCandidates([]*Service{full}))
+}
+
+func TestConfiguredWeights(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgdata := `
+---
+router:
+  methods:
+    echo:
+      balance: weighted
+      weights:
+        - selector: hostname=host1
+          weight: 0
+        - selector: zone=eu
+          weight: 4
+    greet:
+      weights:
+        - selector: zone=eu
+          weight: 4
+        - selector: hostname=host1
+          weight: 0
+`
+	app := NewApp()
+	defer app.Stop()
+	assert.Nil(app.Config.LoadYamldata([]byte(cfgdata)))
+
+	router := NewRouter("default")
+	router.app = app
+
+	weights := router.configuredWeights("echo")
+	assert.Equal(2, len(weights))
+	assert.Equal(0, weightByLabels(weights, map[string]string{"hostname": "host1", "zone": "eu"}, 1))
+	assert.Equal(4, weightByLabels(weights, map[string]string{"hostname": "host2", "zone": "eu"}, 1))
+	assert.Equal(3, weightByLabels(weights, map[string]string{"zone": "us"}, 3))
+	assert.Nil(router.configuredWeights("add"))
+
+	// the selectors are checked in the configured order
+	assert.Equal(4, weightByLabels(router.configuredWeights("greet"), map[string]string{"hostname": "host1", "zone": "eu"}, 1))
+
+	// host1 is weighted 0 and never selected
+	srv1 := NewService(router, nil)
+	assert.Nil(srv1.UpdateOptions(declareOptions{Metadata: serviceMetadata{Hostname: "host1"}}, nil))
+	srv2 := NewService(router, nil)
+	assert.Nil(srv2.UpdateOptions(declareOptions{Metadata: serviceMetadata{Hostname: "host2"}}, nil))
+	router.AddService("echo", srv1)
+	router.AddService("echo", srv2)
+	for i := 0; i < 10; i++ {
+		srv, ok := router.SelectService("echo")
+		assert.True(ok)
+		assert.Equal(srv2, srv)
+	}
+
+	// the configured weights override the weights declared on
+	// remote nodes
+	rsrv := &RemoteService{Services: []serviceSummary{
+		{Methods: []string{"echo"}, Labels: map[string]string{"zone": "eu"}, Weight: 1},
+		{Methods: []string{"echo"}, Labels: map[string]string{"zone": "us"}, Weight: 2},
+	}}
+	assert.Equal(3, rsrv.MethodWeight("echo", nil))
+	assert.Equal(6, rsrv.MethodWeight("echo", weights))
+
+	err := app.Config.LoadYamldata([]byte("router:\n  weights:\n    \"=bad\": 1\n"))
+	assert.NotNil(err)
+}
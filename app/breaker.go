@@ -0,0 +1,194 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// default breaker settings
+const (
+	defaultBreakerErrorRate     = 0.5
+	defaultBreakerMinCalls      = 10
+	defaultBreakerWindow        = time.Second * 30
+	defaultBreakerOpenTimeout   = time.Second * 15
+	defaultBreakerHalfOpenCalls = 1
+)
+
+// circuitBreaker tracks the calls to a remote node. The breaker opens
+// when the failure rate within a window exceeds the threshold, after
+// the open timeout it turns half open and lets a few probe calls
+// through, it closes again if the probes succeed.
+type circuitBreaker struct {
+	lock sync.Mutex
+	cfg  BreakerConfig
+
+	state     string
+	changedAt time.Time
+
+	// counters of the current window
+	windowStart time.Time
+	calls       int
+	failures    int
+
+	// half open probes
+	probes         int
+	probeSuccesses int
+}
+
+func newCircuitBreaker(cfg BreakerConfig) *circuitBreaker {
+	if cfg.ErrorRate <= 0 {
+		cfg.ErrorRate = defaultBreakerErrorRate
+	}
+	if cfg.MinCalls <= 0 {
+		cfg.MinCalls = defaultBreakerMinCalls
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultBreakerWindow
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	if cfg.HalfOpenCalls <= 0 {
+		cfg.HalfOpenCalls = defaultBreakerHalfOpenCalls
+	}
+	now := time.Now()
+	return &circuitBreaker{
+		cfg:         cfg,
+		state:       BreakerClosed,
+		changedAt:   now,
+		windowStart: now,
+	}
+}
+
+// setState changes the state and resets the counters, must be called
+// within lock
+func (self *circuitBreaker) setState(state string, now time.Time) {
+	self.state = state
+	self.changedAt = now
+	self.windowStart = now
+	self.calls = 0
+	self.failures = 0
+	self.probes = 0
+	self.probeSuccesses = 0
+}
+
+// refresh turns an open breaker half open after the open timeout,
+// must be called within lock
+func (self *circuitBreaker) refresh(now time.Time) {
+	if self.state == BreakerOpen && now.Sub(self.changedAt) >= self.cfg.OpenTimeout {
+		self.setState(BreakerHalfOpen, now)
+	}
+}
+
+// Available tells whether the node can be selected
+func (self *circuitBreaker) Available() bool {
+	if self.cfg.Disabled {
+		return true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.refresh(time.Now())
+	switch self.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return self.probes < self.cfg.HalfOpenCalls
+	default:
+		return true
+	}
+}
+
+// Begin marks the start of a call
+func (self *circuitBreaker) Begin() {
+	if self.cfg.Disabled {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.refresh(time.Now())
+	if self.state == BreakerHalfOpen {
+		self.probes++
+	}
+}
+
+// Skip records nothing for a call ended by its caller, the probe
+// taken by Begin is freed
+func (self *circuitBreaker) Skip() {
+	if self.cfg.Disabled {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.state == BreakerHalfOpen && self.probes > 0 {
+		self.probes--
+	}
+}
+
+// Record records the outcome of a call, slow calls count as failures
+func (self *circuitBreaker) Record(failed bool, latency time.Duration) {
+	if self.cfg.Disabled {
+		return
+	}
+	if self.cfg.SlowCall > 0 && latency > self.cfg.SlowCall {
+		failed = true
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	switch self.state {
+	case BreakerHalfOpen:
+		if failed {
+			self.setState(BreakerOpen, now)
+		} else {
+			self.probeSuccesses++
+			if self.probeSuccesses >= self.cfg.HalfOpenCalls {
+				self.setState(BreakerClosed, now)
+			}
+		}
+	case BreakerClosed:
+		if now.Sub(self.windowStart) > self.cfg.Window {
+			self.windowStart = now
+			self.calls = 0
+			self.failures = 0
+		}
+		self.calls++
+		if failed {
+			self.failures++
+		}
+		if self.calls >= self.cfg.MinCalls &&
+			float64(self.failures)/float64(self.calls) >= self.cfg.ErrorRate {
+			self.setState(BreakerOpen, now)
+		}
+	}
+}
+
+func (self *circuitBreaker) State() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.refresh(time.Now())
+	return self.state
+}
+
+func (self *circuitBreaker) Status() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.refresh(time.Now())
+	return map[string]interface{}{
+		"state":      self.state,
+		"changed_at": self.changedAt.UTC().Unix(),
+		"calls":      self.calls,
+		"failures":   self.failures,
+	}
+}
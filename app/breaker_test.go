@@ -0,0 +1,52 @@
+package app
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newCircuitBreaker(BreakerConfig{
+		ErrorRate:   0.5,
+		MinCalls:    4,
+		SlowCall:    time.Second,
+		OpenTimeout: 50 * time.Millisecond,
+	})
+	assert.Equal(BreakerClosed, b.State())
+
+	b.Record(false, time.Millisecond)
+	b.Record(true, time.Millisecond)
+	b.Record(false, time.Millisecond)
+	assert.True(b.Available())
+
+	// a slow call is a failure
+	b.Record(false, 2*time.Second)
+	assert.Equal(BreakerOpen, b.State())
+	assert.False(b.Available())
+
+	// half open after the open timeout, only one probe is allowed
+	time.Sleep(60 * time.Millisecond)
+	assert.True(b.Available())
+	b.Begin()
+	assert.Equal(BreakerHalfOpen, b.State())
+	assert.False(b.Available())
+
+	// the probe fails and the breaker opens again
+	b.Record(true, time.Millisecond)
+	assert.Equal(BreakerOpen, b.State())
+
+	time.Sleep(60 * time.Millisecond)
+
+	// the probe ended by its caller frees the probe
+	b.Begin()
+	assert.False(b.Available())
+	b.Skip()
+	assert.True(b.Available())
+
+	b.Begin()
+	b.Record(false, time.Millisecond)
+	assert.Equal(BreakerClosed, b.State())
+}
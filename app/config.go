@@ -2,6 +2,7 @@ package app
 
 import (
 	"github.com/pkg/errors"
+	"github.com/superisaac/jsoff/net"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"net/url"
@@ -36,6 +37,150 @@ func (self *MQConfig) validateValues() error {
 	return nil
 }
 
+// BreakerConfig
+func (self *BreakerConfig) validateValues() error {
+	if self.ErrorRate < 0 || self.ErrorRate > 1 {
+		return errors.New("breaker error_rate must be within 0~1")
+	}
+	return nil
+}
+
+// ClusterConfig
+func (self *ClusterConfig) validateValues() error {
+	if self.LeaseTTL < 0 || self.SweepInterval < 0 {
+		return errors.New("lease_ttl and sweep_interval must not be negative")
+	}
+	return self.Breaker.validateValues()
+}
+
+// MethodConfig
+func (self *MethodConfig) validateValues() error {
+	if _, err := NewBalancer(self.Balance); err != nil {
+		return err
+	}
+	for _, wcfg := range self.Weights {
+		if _, err := ParseLabelSelector(wcfg.Selector); err != nil {
+			return errors.Wrap(err, "weights")
+		}
+		if wcfg.Weight < 0 {
+			return errors.Errorf("weight of %s is negative", wcfg.Selector)
+		}
+	}
+	if self.Retry != nil {
+		if err := self.Retry.validateValues(); err != nil {
+			return err
+		}
+	}
+	switch self.ValidateReturns {
+	case "", ReturnsOff, ReturnsLog, ReturnsEnforce:
+	default:
+		return errors.Errorf("unknown validate_returns mode %s", self.ValidateReturns)
+	}
+	switch self.SchemaConflict {
+	case "", SchemaConflictWarn, SchemaConflictReject, SchemaConflictAllow:
+	default:
+		return errors.Errorf("unknown schema_conflict mode %s", self.SchemaConflict)
+	}
+	if self.Version != "" {
+		if _, err := ParseVersionConstraint(self.Version); err != nil {
+			return errors.Wrap(err, "version")
+		}
+	}
+	if self.Split != nil {
+		if err := self.Split.validateValues(); err != nil {
+			return err
+		}
+	}
+	if self.Shadow != nil && (self.Shadow.Fraction < 0 || self.Shadow.Fraction > 1) {
+		return errors.New("shadow fraction must be between 0 and 1")
+	}
+	if self.WaitForService < 0 {
+		return errors.New("wait_for_service is negative")
+	}
+	if self.Selector != "" {
+		if _, err := ParseLabelSelector(self.Selector); err != nil {
+			return errors.Wrap(err, "selector")
+		}
+	}
+	return nil
+}
+
+// SplitConfig
+func (self *SplitConfig) validateValues() error {
+	total := 0
+	for group, w := range self.Weights {
+		if w < 0 {
+			return errors.Errorf("split weight of %s is negative", group)
+		}
+		total += w
+	}
+	if total <= 0 {
+		return errors.New("split has no positive weights")
+	}
+	return nil
+}
+
+// RetryConfig
+func (self *RetryConfig) validateValues() error {
+	if self.MaxAttempts < 1 {
+		return errors.New("retry max_attempts must be at least 1")
+	}
+	if self.Backoff < 0 {
+		return errors.New("retry backoff is negative")
+	}
+	return nil
+}
+
+// RouterConfig
+func (self *RouterConfig) validateValues() error {
+	if err := self.MethodConfig.validateValues(); err != nil {
+		return err
+	}
+	if self.Keepalive.Interval < 0 || self.Keepalive.Timeout < 0 || self.Keepalive.MaxMissed < 0 {
+		return errors.New("keepalive values must not be negative")
+	}
+	for mname, mcfg := range self.Methods {
+		if mcfg == nil {
+			continue
+		}
+		if err := mcfg.validateValues(); err != nil {
+			return errors.Wrapf(err, "method %s", mname)
+		}
+	}
+	return nil
+}
+
+// routerConfigs returns the router configs applied to a namespace,
+// the namespace specific one comes first
+func (self *AppConfig) routerConfigs(ns string) []*RouterConfig {
+	cfgs := []*RouterConfig{}
+	if nscfg, ok := self.Namespaces[ns]; ok && nscfg != nil {
+		cfgs = append(cfgs, nscfg)
+	}
+	return append(cfgs, &self.Router)
+}
+
+// lookupMethodSetting picks a setting of method from router configs,
+// method specific settings precede the defaults, namespace settings
+// precede server wide ones, zero value means the setting is absent.
+func lookupMethodSetting[T comparable](appcfg *AppConfig, ns string, method string, pick func(m *MethodConfig) T) T {
+	var zero T
+	cfgs := appcfg.routerConfigs(ns)
+	for _, cfg := range cfgs {
+		if mcfg, ok := cfg.Methods[method]; ok && mcfg != nil {
+			if v := pick(mcfg); v != zero {
+				return v
+			}
+		}
+	}
+	for _, cfg := range cfgs {
+		if v := pick(&cfg.MethodConfig); v != zero {
+			return v
+		}
+	}
+	return zero
+}
+
 func (self *AppConfig) Load(yamlPath string) error {
 	if _, err := os.Stat(yamlPath); os.IsNotExist(err) {
 		if err != nil {
@@ -59,6 +204,17 @@ func (self *AppConfig) LoadYamldata(yamlData []byte) error {
 	return self.validateValues()
 }
 
+// hasNodeBearer tells whether the cluster secret is already a bearer
+// token, the values may be validated more than once
+func (self *AppConfig) hasNodeBearer() bool {
+	for _, bearerCfg := range self.Server.Auth.Bearer {
+		if bearerCfg.Token == self.Cluster.Secret {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *AppConfig) validateValues() error {
 	if self.Server.TLS != nil {
 		err := self.Server.TLS.ValidateValues()
@@ -71,6 +227,15 @@ func (self *AppConfig) validateValues() error {
 		if err != nil {
 			return err
 		}
+		if self.Cluster.Secret != "" && !self.hasNodeBearer() {
+			// let forwarded messages from peer nodes pass the auth
+			// handler, the node identity is verified again in
+			// rpcmux.forward
+			self.Server.Auth.Bearer = append(self.Server.Auth.Bearer, jsoffnet.BearerAuthConfig{
+				Token:    self.Cluster.Secret,
+				Username: "rpcmux.node",
+			})
+		}
 	}
 
 	if !self.MQ.Empty() {
@@ -80,5 +245,21 @@ func (self *AppConfig) validateValues() error {
 		}
 	}
 
+	if err := self.Cluster.validateValues(); err != nil {
+		return errors.Wrap(err, "cluster")
+	}
+
+	if err := self.Router.validateValues(); err != nil {
+		return errors.Wrap(err, "router")
+	}
+	for ns, nscfg := range self.Namespaces {
+		if nscfg == nil {
+			continue
+		}
+		if err := nscfg.validateValues(); err != nil {
+			return errors.Wrapf(err, "namespace %s", ns)
+		}
+	}
+
 	return nil
 }
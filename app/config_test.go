@@ -30,3 +30,76 @@ mq:
 	assert.Equal("/2", u.Path)
 	assert.NotNil(appcfg.MQ.url)
 }
+
+func TestValidateParamsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgdata := `
+---
+router:
+  validate_params: false
+namespaces:
+  eastasia:
+    validate_params: true
+`
+	app := NewApp()
+	defer app.Stop()
+	err := app.Config.LoadYamldata([]byte(cfgdata))
+	assert.Nil(err)
+
+	router := NewRouter("default")
+	router.app = app
+	assert.False(router.paramsValidated())
+
+	router1 := NewRouter("eastasia")
+	router1.app = app
+	assert.True(router1.paramsValidated())
+}
+
+func TestNodeBearerConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgdata := `
+---
+server:
+  auth:
+    bearer:
+      - token: atoken
+cluster:
+  secret: nodesecret
+`
+	appcfg := &AppConfig{}
+	assert.Nil(appcfg.LoadYamldata([]byte(cfgdata)))
+	assert.Equal(2, len(appcfg.Server.Auth.Bearer))
+	assert.Equal("nodesecret", appcfg.Server.Auth.Bearer[1].Token)
+
+	// validating again adds no more token
+	assert.Nil(appcfg.validateValues())
+	assert.Equal(2, len(appcfg.Server.Auth.Bearer))
+}
+
+func TestIdempotentConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgdata := `
+---
+router:
+  idempotent: true
+  retry:
+    max_attempts: 3
+  methods:
+    charge:
+      idempotent: false
+`
+	app := NewApp()
+	defer app.Stop()
+	err := app.Config.LoadYamldata([]byte(cfgdata))
+	assert.Nil(err)
+
+	router := NewRouter("default")
+	router.app = app
+	assert.NotNil(router.retryPolicy("query"))
+
+	// opts out of the router default
+	assert.Nil(router.retryPolicy("charge"))
+}
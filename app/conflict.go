@@ -0,0 +1,291 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/schema"
+	"sort"
+	"strings"
+)
+
+// modes to handle services declaring different schemas of a method
+const (
+	// accept the declaration and log a warning
+	SchemaConflictWarn = "warn"
+
+	// fail the declaration
+	SchemaConflictReject = "reject"
+
+	// accept the declaration as a distinct schema of the method,
+	// calls name the schema by its hash such as add#1a2b3c4d5e6f7a8b
+	// and the calls without a hash go to the services of the primary
+	// schema, the one declared earliest
+	SchemaConflictAllow = "allow"
+)
+
+type schemaKey struct{}
+
+// withSchemaHash returns a ctx carrying the schema hash of the method
+// being routed, forwarded to remote nodes along with the message
+func withSchemaHash(ctx context.Context, h string) context.Context {
+	return context.WithValue(ctx, schemaKey{}, h)
+}
+
+func schemaHashFrom(ctx context.Context) string {
+	if h, ok := ctx.Value(schemaKey{}).(string); ok {
+		return h
+	}
+	return ""
+}
+
+// splitSchemaHash splits a method name such as add#1a2b3c4d@1.2 to
+// add@1.2 and the schema hash
+func splitSchemaHash(name string) (string, string) {
+	i := strings.Index(name, "#")
+	if i <= 0 {
+		return name, ""
+	}
+	rest := name[i+1:]
+	if j := strings.Index(rest, "@"); j >= 0 {
+		return name[:i] + rest[j:], rest[:j]
+	}
+	return name[:i], rest
+}
+
+// resolveSchema strips the schema hash from the method of a request
+// or notify
+func (self *Router) resolveSchema(msg jsoff.Message) (jsoff.Message, string) {
+	method, h := splitSchemaHash(msg.MustMethod())
+	if h == "" {
+		return msg, ""
+	}
+	return renameMessage(msg, method), h
+}
+
+func (self *Router) schemaConflictMode(method string) string {
+	return lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) string {
+		return m.SchemaConflict
+	})
+}
+
+// primarySchemaHash returns the schema hash of a method declared by
+// the earliest local service matching the version constraint, or by a
+// remote node if no local service declares a schema
+func (self *Router) primarySchemaHash(method string, c *VersionConstraint) string {
+	crit := &selectCriteria{version: c}
+
+	self.serviceLock.RLock()
+	for _, srv := range self.methodServicesIndex[method] {
+		if h := srv.SchemaHash(method); h != "" && crit.accept(method, srv) {
+			self.serviceLock.RUnlock()
+			return h
+		}
+	}
+	self.serviceLock.RUnlock()
+
+	self.remoteServiceLock.RLock()
+	defer self.remoteServiceLock.RUnlock()
+	for _, rsrv := range self.methodRemoteServices[method] {
+		if hs := rsrv.Schemas[method]; len(hs) > 0 && crit.accept(method, rsrv) {
+			return hs[0]
+		}
+	}
+	return ""
+}
+
+// schemaHash returns a digest of a schema, empty for methods without
+// schema which conflict with nothing
+func schemaHash(s jsoffschema.Schema) string {
+	if s == nil {
+		return ""
+	}
+	// json encoding sorts the map keys
+	data, err := json.Marshal(s.Map())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SchemaHashes returns the schema hashes of methods declared by local
+// services, published within the status
+func (self *Router) SchemaHashes() map[string][]string {
+	hashes := map[string][]string{}
+	self.serviceIndex.Range(func(k, v interface{}) bool {
+		service, _ := v.(*Service)
+		for mname, s := range service.Methods() {
+			if h := schemaHash(s); h != "" && !stringInList(h, hashes[mname]) {
+				hashes[mname] = append(hashes[mname], h)
+			}
+		}
+		return true
+	})
+	return hashes
+}
+
+// checkSchemaConflicts compares the schemas a service declares with
+// the ones declared by other local services and remote nodes, versions
+// are the versions of the methods being declared, checked before the
+// declaration is applied to the service
+func (self *Router) checkSchemaConflicts(service *Service, schemas map[string]jsoffschema.Schema, versions map[string]Version) error {
+	rejected := []string{}
+	for mname, s := range schemas {
+		h := schemaHash(s)
+		if h == "" {
+			continue
+		}
+		mode := self.schemaConflictMode(mname)
+		if mode == SchemaConflictAllow {
+			continue
+		}
+		others := self.otherSchemaHashes(mname, service, versions)
+		conflicted := false
+		for other := range others {
+			if other != h {
+				conflicted = true
+				break
+			}
+		}
+		if !conflicted {
+			continue
+		}
+		if mode == SchemaConflictReject {
+			rejected = append(rejected, mname)
+		} else {
+			self.Log().Warnf("schema of %s conflicts with other services", mname)
+		}
+	}
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		return &jsoff.RPCError{
+			Code:    ErrSchemaConflict.Code,
+			Message: ErrSchemaConflict.Message,
+			Data: map[string]interface{}{
+				"methods": rejected,
+			},
+		}
+	}
+	return nil
+}
+
+// otherSchemaHashes returns the schema hashes of a method declared by
+// local services but except and by remote nodes, a versioned method
+// is only compared with the same version of local services
+func (self *Router) otherSchemaHashes(method string, except *Service, versions map[string]Version) map[string]bool {
+	hashes := map[string]bool{}
+	version, versioned := versions[method]
+
+	self.serviceLock.RLock()
+	for _, srv := range self.methodServicesIndex[method] {
+		if srv == except {
+			continue
+		}
+		if v, ok := srv.Version(method); ok != versioned || (ok && v.Compare(version) != 0) {
+			continue
+		}
+		if h := srv.SchemaHash(method); h != "" {
+			hashes[h] = true
+		}
+	}
+	self.serviceLock.RUnlock()
+
+	if versioned {
+		return hashes
+	}
+	self.remoteServiceLock.RLock()
+	for _, rsrv := range self.methodRemoteServices[method] {
+		for _, h := range rsrv.Schemas[method] {
+			hashes[h] = true
+		}
+	}
+	self.remoteServiceLock.RUnlock()
+	return hashes
+}
+
+// Conflicts lists the methods whose schemas differ across local
+// services and remote nodes
+func (self *Router) Conflicts() []map[string]interface{} {
+	// method => hash => holders
+	sessions := map[string]map[string][]string{}
+	nodes := map[string]map[string][]string{}
+	add := func(index map[string]map[string][]string, method, h, holder string) {
+		if _, ok := index[method]; !ok {
+			index[method] = map[string][]string{}
+		}
+		index[method][h] = append(index[method][h], holder)
+	}
+
+	self.serviceIndex.Range(func(k, v interface{}) bool {
+		sid, _ := k.(string)
+		service, _ := v.(*Service)
+		for mname, s := range service.Methods() {
+			if h := schemaHash(s); h != "" {
+				add(sessions, mname, h, sid)
+			}
+		}
+		return true
+	})
+	self.remoteServiceIndex.Range(func(k, v interface{}) bool {
+		rsrv, _ := v.(*RemoteService)
+		for mname, hs := range rsrv.Schemas {
+			for _, h := range hs {
+				add(nodes, mname, h, rsrv.AdvertiseUrl)
+			}
+		}
+		return true
+	})
+
+	methods := []string{}
+	for mname, _ := range sessions {
+		methods = append(methods, mname)
+	}
+	for mname, _ := range nodes {
+		if _, ok := sessions[mname]; !ok {
+			methods = append(methods, mname)
+		}
+	}
+	sort.Strings(methods)
+
+	conflicts := []map[string]interface{}{}
+	for _, mname := range methods {
+		hashes := []string{}
+		for h, _ := range sessions[mname] {
+			hashes = append(hashes, h)
+		}
+		for h, _ := range nodes[mname] {
+			if _, ok := sessions[mname][h]; !ok {
+				hashes = append(hashes, h)
+			}
+		}
+		if len(hashes) < 2 {
+			continue
+		}
+		sort.Strings(hashes)
+		schemas := []map[string]interface{}{}
+		for _, h := range hashes {
+			schemas = append(schemas, map[string]interface{}{
+				"hash":     h,
+				"sessions": append([]string{}, sessions[mname][h]...),
+				"nodes":    append([]string{}, nodes[mname][h]...),
+			})
+		}
+		conflicts = append(conflicts, map[string]interface{}{
+			"method":  mname,
+			"schemas": schemas,
+		})
+	}
+	return conflicts
+}
+
+func stringInList(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package app
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/net"
+	"github.com/superisaac/jsoff/schema"
+	"testing"
+	"time"
+)
+
+type fakeSession struct {
+	sid string
+}
+
+func (self fakeSession) Context() context.Context {
+	return context.Background()
+}
+
+func (self fakeSession) Send(msg jsoff.Message) {}
+
+func (self fakeSession) SessionID() string {
+	return self.sid
+}
+
+func buildSchema(t *testing.T, yamlStr string) jsoffschema.Schema {
+	builder := jsoffschema.NewSchemaBuilder()
+	s, err := builder.BuildYamlBytes([]byte(yamlStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSchemaConflicts(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+	app.Config.Router.Methods = map[string]*MethodConfig{
+		"add": {SchemaConflict: SchemaConflictReject},
+	}
+
+	router := NewRouter("default")
+	router.app = app
+
+	s1 := buildSchema(t, "{type: method, params: [{type: number}, {type: number}]}")
+	s2 := buildSchema(t, "{type: method, params: [{type: string}]}")
+	assert.NotEqual(schemaHash(s1), schemaHash(s2))
+	assert.Equal(schemaHash(s1), schemaHash(buildSchema(t, "{type: method, params: [{type: number}, {type: number}]}")))
+
+	srv1 := NewService(router, nil)
+	router.serviceIndex.Store("session1", srv1)
+	assert.Nil(router.checkSchemaConflicts(srv1, map[string]jsoffschema.Schema{"add": s1, "echo": s1}, nil))
+	assert.Nil(srv1.UpdateMethods(map[string]jsoffschema.Schema{"add": s1, "echo": s1}))
+
+	// the same schema, or no schema, never conflicts
+	srv2 := NewService(router, nil)
+	assert.Nil(router.checkSchemaConflicts(srv2, map[string]jsoffschema.Schema{"add": s1, "echo": nil}, nil))
+
+	// add is rejected while echo is warned only
+	err := router.checkSchemaConflicts(srv2, map[string]jsoffschema.Schema{"add": s2, "echo": s2}, nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "schema conflict")
+
+	// redeclaring its own methods is no conflict
+	assert.Nil(router.checkSchemaConflicts(srv1, map[string]jsoffschema.Schema{"add": s2}, nil))
+
+	router.serviceIndex.Store("session2", srv2)
+	assert.Nil(srv2.UpdateMethods(map[string]jsoffschema.Schema{"echo": s2}))
+
+	now := time.Now()
+	router.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16131",
+		Methods:      []string{"add"},
+		Schemas:      map[string][]string{"add": {schemaHash(s2)}},
+		Timestamp:    now.Unix(),
+	}, now)
+
+	conflicts := router.Conflicts()
+	assert.Equal(2, len(conflicts))
+	assert.Equal("add", conflicts[0]["method"])
+	assert.Equal("echo", conflicts[1]["method"])
+	schemas, _ := conflicts[0]["schemas"].([]map[string]interface{})
+	assert.Equal(2, len(schemas))
+	for _, sinfo := range schemas {
+		if sinfo["hash"] == schemaHash(s2) {
+			assert.Equal([]string{"http://127.0.0.1:16131"}, sinfo["nodes"])
+		} else {
+			assert.Equal([]string{"session1"}, sinfo["sessions"])
+		}
+	}
+}
+
+func TestDeclareRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+	app.Config.Router.Methods = map[string]*MethodConfig{
+		"add": {SchemaConflict: SchemaConflictReject},
+	}
+	router := app.GetRouter("default")
+	actor := NewActor(app)
+
+	declare := func(sid string, methods map[string]interface{}, opts map[string]interface{}) jsoff.Message {
+		reqmsg := jsoff.NewRequestMessage(1, "rpcmux.declare", []interface{}{methods, opts})
+		req := jsoffnet.NewRPCRequest(context.Background(), reqmsg, jsoffnet.TransportHTTP).WithSession(fakeSession{sid: sid})
+		resmsg, err := actor.Feed(req)
+		assert.Nil(err)
+		return resmsg
+	}
+	s1 := map[string]interface{}{"type": "method", "params": []interface{}{map[string]interface{}{"type": "number"}}}
+	s2 := map[string]interface{}{"type": "method", "params": []interface{}{map[string]interface{}{"type": "string"}}}
+
+	assert.True(declare("session1", map[string]interface{}{"add@1.0.0": s1}, nil).IsResult())
+	assert.True(declare("session2", map[string]interface{}{"add": s1}, nil).IsResult())
+
+	// the rejected declaration changes neither options nor names
+	resmsg := declare("session2", map[string]interface{}{"add@1.0.0": s2}, map[string]interface{}{
+		"methods": map[string]interface{}{"add@1.0.0": map[string]interface{}{"timeout": 5}},
+	})
+	assert.True(resmsg.IsError())
+	assert.Equal(ErrSchemaConflict.Code, resmsg.MustError().Code)
+
+	v, _ := router.serviceIndex.Load("session2")
+	srv2, _ := v.(*Service)
+	_, versioned := srv2.Version("add")
+	assert.False(versioned)
+	_, ok := srv2.Timeout("add")
+	assert.False(ok)
+	assert.Equal(0, len(srv2.options().names))
+}
+
+type recordSession struct {
+	sid  string
+	sent chan jsoff.Message
+}
+
+func (self recordSession) Context() context.Context {
+	return context.Background()
+}
+
+func (self recordSession) Send(msg jsoff.Message) {
+	self.sent <- msg
+}
+
+func (self recordSession) SessionID() string {
+	return self.sid
+}
+
+func TestSchemaAllow(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+	app.Config.Router.Methods = map[string]*MethodConfig{
+		"add": {SchemaConflict: SchemaConflictAllow},
+	}
+	router := app.GetRouter("default")
+	actor := NewActor(app)
+
+	feed := func(reqmsg *jsoff.RequestMessage, session jsoffnet.RPCSession) jsoff.Message {
+		req := jsoffnet.NewRPCRequest(context.Background(), reqmsg, jsoffnet.TransportHTTP)
+		if session != nil {
+			req = req.WithSession(session)
+		}
+		resmsg, err := actor.Feed(req)
+		assert.Nil(err)
+		return resmsg
+	}
+	s1 := map[string]interface{}{"type": "method", "params": []interface{}{map[string]interface{}{"type": "number"}}}
+	s2 := map[string]interface{}{"type": "method", "params": []interface{}{map[string]interface{}{"type": "string"}}}
+
+	session1 := recordSession{sid: "session1", sent: make(chan jsoff.Message, 10)}
+	session2 := recordSession{sid: "session2", sent: make(chan jsoff.Message, 10)}
+	assert.True(feed(jsoff.NewRequestMessage(1, "rpcmux.declare", []interface{}{map[string]interface{}{"add": s1}}), session1).IsResult())
+	assert.True(feed(jsoff.NewRequestMessage(2, "rpcmux.declare", []interface{}{map[string]interface{}{"add": s2}}), session2).IsResult())
+
+	v, _ := router.serviceIndex.Load("session2")
+	srv2, _ := v.(*Service)
+	h2 := srv2.SchemaHash("add")
+	assert.NotEqual("", h2)
+	assert.NotEqual(h2, router.primarySchemaHash("add", nil))
+
+	// the schema is the primary one unless named by the hash
+	paramType := func(method string) string {
+		var res struct {
+			Params []struct {
+				Type string
+			}
+		}
+		resmsg := feed(jsoff.NewRequestMessage(3, "rpcmux.schema", []interface{}{method}), nil)
+		assert.True(resmsg.IsResult(), jsoff.MessageString(resmsg))
+		assert.Nil(jsoff.DecodeInterface(resmsg.MustResult(), &res))
+		assert.Equal(1, len(res.Params))
+		return res.Params[0].Type
+	}
+	assert.Equal("number", paramType("add"))
+	assert.Equal("string", paramType("add#"+h2))
+
+	// calls go to the services of the schema
+	for i := 0; i < 5; i++ {
+		_, err := router.Feed(context.Background(), jsoff.NewNotifyMessage("add", []interface{}{1}))
+		assert.Nil(err)
+		_, err = router.Feed(context.Background(), jsoff.NewNotifyMessage("add#"+h2, []interface{}{"a"}))
+		assert.Nil(err)
+	}
+	assert.Equal(5, len(session1.sent))
+	assert.Equal(5, len(session2.sent))
+	msg := <-session2.sent
+	assert.Equal("add", msg.MustMethod())
+	assert.Equal([]interface{}{"a"}, msg.MustParams())
+
+	// the hash goes to remote nodes before the version constraint
+	mname, h := splitSchemaHash("add#" + h2 + "@^1.2")
+	assert.Equal("add@^1.2", mname)
+	assert.Equal(h2, h)
+	env := router.newForwardEnvelope(withSchemaHash(context.Background(), h2), jsoff.NewNotifyMessage("add", []interface{}{"a"}), 0)
+	assert.Equal("add#"+h2, env.Method)
+
+	// the params are checked against the schema of the hash
+	_, err := router.Feed(context.Background(), jsoff.NewNotifyMessage("add#"+h2, []interface{}{1}))
+	assert.Nil(err)
+	assert.Equal(4, len(session2.sent))
+}
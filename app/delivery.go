@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"github.com/superisaac/jsoff"
+	"sync"
+)
+
+// delivery modes of notify methods declared by workers, a notify of
+// undeclared mode goes to one local service
+const (
+	// deliver to every local and remote service
+	DeliveryBroadcast = "broadcast"
+
+	// deliver to one service cluster-wide, local services first
+	DeliveryAny = "any"
+)
+
+func validDelivery(delivery string) bool {
+	switch delivery {
+	case "", DeliveryBroadcast, DeliveryAny:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliveryMode returns the delivery mode of a method declared by the
+// local and remote services, broadcast wins if they disagree
+func (self *Router) deliveryMode(method string) string {
+	mode := ""
+	pick := func(d string) {
+		if d == DeliveryBroadcast || (d == DeliveryAny && mode == "") {
+			mode = d
+		}
+	}
+
+	self.serviceLock.RLock()
+	for _, srv := range self.methodServicesIndex[method] {
+		pick(srv.options().deliveries[method])
+	}
+	self.serviceLock.RUnlock()
+
+	self.remoteServiceLock.RLock()
+	for _, rsrv := range self.methodRemoteServices[method] {
+		pick(rsrv.Deliveries[method])
+	}
+	self.remoteServiceLock.RUnlock()
+	return mode
+}
+
+// Deliveries returns the delivery modes declared by local services
+func (self *Router) Deliveries() map[string]string {
+	deliveries := map[string]string{}
+	self.serviceIndex.Range(func(k, v interface{}) bool {
+		service, _ := v.(*Service)
+		for mname, d := range service.options().deliveries {
+			if deliveries[mname] != DeliveryBroadcast {
+				deliveries[mname] = d
+			}
+		}
+		return true
+	})
+	return deliveries
+}
+
+// broadcast delivers a notify to all local services, and to all
+// remote nodes unless the notify is forwarded from another node, which
+// has fanned out already
+func (self *Router) broadcast(ctx context.Context, ntfmsg *jsoff.NotifyMessage, crit *selectCriteria) {
+	self.serviceLock.RLock()
+	services := append([]*Service{}, self.methodServicesIndex[ntfmsg.Method]...)
+	self.serviceLock.RUnlock()
+
+	for _, service := range services {
+		if !crit.accept(ntfmsg.Method, service) {
+			continue
+		}
+		if err := service.Send(ntfmsg); err != nil {
+			ntfmsg.Log().Warnf("broadcast to service error, %s", err)
+		}
+	}
+
+	if forwardHops(ctx) > 0 {
+		return
+	}
+	self.remoteServiceLock.RLock()
+	rsrvs := append([]*RemoteService{}, self.methodRemoteServices[ntfmsg.Method]...)
+	self.remoteServiceLock.RUnlock()
+
+	// nodes are notified aside so that an unreachable one delays
+	// none of the others
+	wg := &sync.WaitGroup{}
+	for _, rsrv := range rsrvs {
+		if !crit.accept(ntfmsg.Method, rsrv) || !rsrv.breaker.Available() {
+			continue
+		}
+		wg.Add(1)
+		go func(rsrv *RemoteService) {
+			defer wg.Done()
+			if err := self.notifyRemoteService(ctx, rsrv, ntfmsg); err != nil {
+				ntfmsg.Log().Warnf("broadcast to node %s error, %s", rsrv.AdvertiseUrl, err)
+			}
+		}(rsrv)
+	}
+	wg.Wait()
+}
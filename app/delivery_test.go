@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jsoff"
+	"testing"
+	"time"
+)
+
+func TestDeliveryMode(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+
+	router := NewRouter("default")
+	router.app = app
+
+	srv := NewService(router, nil)
+	assert.Nil(srv.UpdateOptions(declareOptions{
+		Methods: map[string]declareMethodOptions{
+			"refresh": {Delivery: DeliveryAny},
+		},
+	}, nil))
+	router.serviceIndex.Store("session1", srv)
+	router.AddService("refresh", srv)
+	router.AddService("invalidate", srv)
+	assert.Equal(DeliveryAny, router.deliveryMode("refresh"))
+	assert.Equal("", router.deliveryMode("invalidate"))
+
+	// remote nodes declare invalidate as broadcast
+	now := time.Now()
+	router.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16091",
+		Methods:      []string{"invalidate", "refresh"},
+		Deliveries:   map[string]string{"invalidate": DeliveryBroadcast},
+		Timestamp:    now.Unix(),
+	}, now)
+	assert.Equal(DeliveryBroadcast, router.deliveryMode("invalidate"))
+	assert.Equal(DeliveryAny, router.deliveryMode("refresh"))
+	assert.Equal(map[string]string{"refresh": DeliveryAny}, router.Deliveries())
+
+	err := srv.UpdateOptions(declareOptions{
+		Methods: map[string]declareMethodOptions{
+			"refresh": {Delivery: "bad"},
+		},
+	}, nil)
+	assert.NotNil(err)
+}
+
+func TestBroadcastUnreachable(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+
+	router := NewRouter("default")
+	router.app = app
+
+	// nodes not listening
+	now := time.Now()
+	for _, advUrl := range []string{"http://127.0.0.1:16311", "http://127.0.0.1:16312", "http://127.0.0.1:16313"} {
+		router.applyStatus(serviceStatus{
+			AdvertiseUrl: advUrl,
+			Methods:      []string{"invalidate"},
+			Deliveries:   map[string]string{"invalidate": DeliveryBroadcast},
+			Timestamp:    now.Unix(),
+		}, now)
+	}
+	opened := router.GetOrCreateRemoteService("http://127.0.0.1:16313")
+	opened.breaker.lock.Lock()
+	opened.breaker.setState(BreakerOpen, time.Now())
+	opened.breaker.lock.Unlock()
+
+	// the notify is held no longer than one link timeout
+	start := time.Now()
+	_, err := router.Feed(context.Background(), jsoff.NewNotifyMessage("invalidate", []interface{}{}))
+	assert.Nil(err)
+	assert.True(time.Since(start) < linkNotifyTimeout+500*time.Millisecond)
+
+	// the node of an open breaker is skipped
+	assert.Nil(opened.link)
+}
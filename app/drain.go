@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jsoff"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = time.Second * 30
+
+	// how often draining checks the pending requests
+	drainCheckInterval = time.Millisecond * 50
+)
+
+// Draining tells whether the service is draining, a draining service
+// gets no new requests
+func (self *Service) Draining() bool {
+	return atomic.LoadInt32(&self.draining) != 0
+}
+
+// DrainService stops choosing a service, the worker is told by the
+// rpcmux.drained notify that it can disconnect once the requests
+// pending on it complete
+func (self *Router) DrainService(service *Service) {
+	if !atomic.CompareAndSwapInt32(&service.draining, 0, 1) {
+		return
+	}
+	if self.runContext() != nil {
+		self.schedulePublish()
+	}
+	go func() {
+		ticker := time.NewTicker(drainCheckInterval)
+		defer ticker.Stop()
+		for service.Pending() > 0 {
+			<-ticker.C
+		}
+		if session := service.session; session != nil {
+			session.Send(jsoff.NewNotifyMessage("rpcmux.drained", nil))
+		}
+	}()
+}
+
+// Draining tells whether the router refuses new calls
+func (self *Router) Draining() bool {
+	return atomic.LoadInt32(&self.draining) != 0
+}
+
+// Drain refuses new calls and publishes an empty status so that peer
+// nodes stop forwarding to this node
+func (self *Router) Drain(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&self.draining, 0, 1) {
+		return
+	}
+	self.Log().Infof("router draining")
+	if err := self.publishEmptyStatus(ctx); err != nil {
+		self.Log().Errorf("publish empty status error, %s", err)
+	}
+}
+
+// PendingCount returns the number of requests in flight on local and
+// remote services
+func (self *Router) PendingCount() int64 {
+	count := int64(self.pendings.Len())
+	self.remoteServiceIndex.Range(func(k, v interface{}) bool {
+		rsrv, _ := v.(*RemoteService)
+		count += rsrv.Pending()
+		return true
+	})
+	return count
+}
+
+// Drain drains all routers and waits for the pending requests to
+// complete until ctx is done, returns the number of requests left
+func (self *App) Drain(ctx context.Context) int64 {
+	routers := []*Router{}
+	self.routers.Range(func(k, v interface{}) bool {
+		router, _ := v.(*Router)
+		router.Drain(ctx)
+		routers = append(routers, router)
+		return true
+	})
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		left := int64(0)
+		for _, router := range routers {
+			left += router.PendingCount()
+		}
+		if left == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			log.Warnf("drain deadline exceeded, %d requests left", left)
+			return left
+		case <-ticker.C:
+		}
+	}
+}
+
+// DrainTimeout returns how long the node waits for pending requests
+// on shutdown
+func (self *App) DrainTimeout() time.Duration {
+	if self.Config.Server.DrainTimeout > 0 {
+		return self.Config.Server.DrainTimeout
+	}
+	return defaultDrainTimeout
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/rpcmux/mq"
+	"testing"
+	"time"
+)
+
+// fakeMQ records the notifies added
+type fakeMQ struct {
+	added []*jsoff.NotifyMessage
+}
+
+func (self *fakeMQ) Add(ctx context.Context, section string, ntf *jsoff.NotifyMessage) (string, error) {
+	self.added = append(self.added, ntf)
+	return "", nil
+}
+
+func (self *fakeMQ) Chunk(ctx context.Context, section string, lastOffset string, count int64) (mq.MQChunk, error) {
+	return mq.MQChunk{}, nil
+}
+
+func (self *fakeMQ) Tail(ctx context.Context, section string, count int64) (mq.MQChunk, error) {
+	return mq.MQChunk{}, nil
+}
+
+func (self *fakeMQ) Subscribe(ctx context.Context, section string, output chan mq.MQItem) error {
+	return nil
+}
+
+func TestDrainApp(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+	router := app.GetRouter("default")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Equal(int64(0), app.Drain(ctx))
+	assert.True(router.Draining())
+
+	reqmsg := jsoff.NewRequestMessage(1, "echo", nil)
+	res, err := router.Feed(context.Background(), reqmsg)
+	assert.Nil(err)
+	resmsg, _ := res.(jsoff.Message)
+	assert.Equal(ErrDraining.Code, resmsg.MustError().Code)
+
+	srv := &Service{draining: 1}
+	assert.False((*selectCriteria)(nil).accept("echo", srv))
+}
+
+func TestDrainPublishStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+	app.Config.Server.AdvertiseUrl = "http://127.0.0.1:16281"
+
+	router := NewRouter("default")
+	router.app = app
+	fake := &fakeMQ{}
+	router.mqClient = fake
+	router.AddService("echo", NewService(router, nil))
+
+	published := func() []string {
+		ntf := fake.added[len(fake.added)-1]
+		var st serviceStatus
+		assert.Nil(jsoff.DecodeInterface(ntf.Params[0], &st))
+		return st.Methods
+	}
+
+	ctx := context.Background()
+	assert.Nil(router.publishStatus(ctx))
+	assert.Equal([]string{"echo"}, published())
+
+	router.Drain(ctx)
+	assert.Equal([]string{}, published())
+
+	// the next publish cycle keeps the status empty
+	assert.Nil(router.publishStatus(ctx))
+	assert.Equal(3, len(fake.added))
+	assert.Equal([]string{}, published())
+}
@@ -0,0 +1,46 @@
+package app
+
+import (
+	"fmt"
+	"github.com/superisaac/jsoff"
+	"time"
+)
+
+// timeout limits, tell which limit a timed out request hits
+const (
+	TimeoutByDefault = "default"
+	TimeoutByMethod  = "method"
+	TimeoutByWorker  = "worker"
+	TimeoutByCaller  = "caller"
+)
+
+var (
+	ErrServiceGone    = &jsoff.RPCError{Code: 210, Message: "service gone", Data: nil}
+	ErrAdminRequired  = &jsoff.RPCError{Code: 403, Message: "admin role required", Data: nil}
+	ErrSchemaConflict = &jsoff.RPCError{Code: 211, Message: "schema conflict", Data: nil}
+	ErrNoProvider     = &jsoff.RPCError{Code: 212, Message: "no provider", Data: nil}
+	ErrDraining       = &jsoff.RPCError{Code: 213, Message: "node draining", Data: nil}
+	ErrWorkerBusy     = &jsoff.RPCError{Code: 214, Message: "worker busy", Data: nil}
+)
+
+func noProviderError(method string, grace time.Duration) *jsoff.RPCError {
+	return &jsoff.RPCError{
+		Code:    ErrNoProvider.Code,
+		Message: fmt.Sprintf("no provider of %s within %s", method, grace),
+		Data: map[string]interface{}{
+			"method": method,
+			"wait":   grace.Seconds(),
+		},
+	}
+}
+
+func timeoutError(limit string, timeout time.Duration) *jsoff.RPCError {
+	return &jsoff.RPCError{
+		Code:    jsoff.ErrTimeout.Code,
+		Message: fmt.Sprintf("request timeout, %s limit %s exceeded", limit, timeout),
+		Data: map[string]interface{}{
+			"limit":   limit,
+			"timeout": timeout.Seconds(),
+		},
+	}
+}
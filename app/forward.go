@@ -0,0 +1,222 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMaxHops = 1
+)
+
+// forwardEnvelope wraps a message forwarded to another rpcmux node,
+// carrying the namespace, the caller's identity, the remaining time
+// and the hop counter
+type forwardEnvelope struct {
+	Namespace string                 `json:"namespace"`
+	Username  string                 `json:"username,omitempty"`
+	Settings  map[string]interface{} `json:"settings,omitempty"`
+
+	// remaining time of the caller in seconds, 0 means no deadline
+	Timeout float64 `json:"timeout,omitempty"`
+	Hops    int     `json:"hops"`
+
+	// makes the split decisions sticky
+	HashKey string `json:"hash_key,omitempty"`
+
+	// label selector of services
+	Selector string `json:"selector,omitempty"`
+
+	// nil for notifies
+	Id      interface{}   `json:"id,omitempty"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	TraceId string        `json:"traceid,omitempty"`
+}
+
+type hopsKey struct{}
+
+// forwardHops returns how many times the message in ctx has been
+// forwarded between nodes
+func forwardHops(ctx context.Context) int {
+	if v, ok := ctx.Value(hopsKey{}).(int); ok {
+		return v
+	}
+	return 0
+}
+
+func (self *App) maxHops() int {
+	if self.Config.Cluster.MaxHops > 0 {
+		return self.Config.Cluster.MaxHops
+	}
+	return defaultMaxHops
+}
+
+// nodeAuthHeader returns the header a node authenticates itself with
+// when forwarding messages to other nodes
+func (self *App) nodeAuthHeader() http.Header {
+	h := http.Header{}
+	if self.Config.Cluster.Secret != "" {
+		h.Set("Authorization", "Bearer "+self.Config.Cluster.Secret)
+	}
+	return h
+}
+
+// verifyNode checks whether a request comes from a peer node, a
+// cluster without secret is only allowed when the server requires no
+// auth
+func (self *App) verifyNode(req *jsoffnet.RPCRequest) bool {
+	secret := self.Config.Cluster.Secret
+	if secret == "" {
+		return self.Config.Server.Auth == nil
+	}
+	r := httpRequest(req)
+	if r == nil {
+		return false
+	}
+	expect := []byte("Bearer " + secret)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expect) == 1
+}
+
+// newForwardEnvelope wraps a request or notify forwarded within ctx,
+// timeout is the time left for the request
+func (self *Router) newForwardEnvelope(ctx context.Context, msg jsoff.Message, timeout time.Duration) forwardEnvelope {
+	env := forwardEnvelope{
+		Namespace: self.namespace,
+		Timeout:   timeout.Seconds(),
+		Hops:      forwardHops(ctx) + 1,
+		Method:    msg.MustMethod(),
+		Params:    msg.MustParams(),
+		TraceId:   msg.TraceId(),
+	}
+	if msg.IsRequest() {
+		env.Id = msg.MustId()
+	}
+	env.HashKey = hashKeyFrom(ctx)
+	if sel := selectorFrom(ctx); sel != nil {
+		env.Selector = sel.String()
+	}
+	if h := schemaHashFrom(ctx); h != "" {
+		env.Method += "#" + h
+	}
+	if c := versionConstraintFrom(ctx); c != nil {
+		env.Method += "@" + c.String()
+	}
+	if authinfo, ok := jsoffnet.AuthInfoFromContext(ctx); ok && authinfo != nil {
+		env.Username = authinfo.Username
+		env.Settings = authinfo.Settings
+	}
+	return env
+}
+
+// authInfoKey is the key jsoffnet.NewAuthHandler stores the auth info
+// by, jsoffnet exports no setter so the key is pinned by
+// TestWithAuthInfo against jsoffnet.AuthInfoFromContext
+const authInfoKey = "authInfo"
+
+// withAuthInfo returns a ctx carrying the auth info as if the request
+// passed the auth handler
+func withAuthInfo(ctx context.Context, authinfo *jsoffnet.AuthInfo) context.Context {
+	return context.WithValue(ctx, authInfoKey, authinfo)
+}
+
+// handleForward routes a message forwarded from a peer node within
+// the namespace and identity of the original caller
+func (self *App) handleForward(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+	if !self.verifyNode(req) {
+		return nil, jsoff.ErrAuthFailed
+	}
+	var env forwardEnvelope
+	if len(params) == 0 {
+		return nil, jsoff.ParamsError("no envelope")
+	}
+	if err := jsoff.DecodeInterface(params[0], &env); err != nil {
+		return nil, jsoff.ParamsError(fmt.Sprintf("bad envelope, %s", err))
+	}
+	if env.Namespace == "" || env.Method == "" {
+		return nil, jsoff.ParamsError("envelope has no namespace or method")
+	}
+
+	ctx := req.Context()
+	// the caller's identity
+	ctx = withAuthInfo(ctx, &jsoffnet.AuthInfo{
+		Username: env.Username,
+		Settings: env.Settings,
+	})
+	ctx = context.WithValue(ctx, hopsKey{}, env.Hops)
+	if env.HashKey != "" {
+		ctx = withHashKey(ctx, env.HashKey)
+	}
+	if env.Selector != "" {
+		ctx = withSelectorText(ctx, env.Selector)
+	}
+	var cancel func()
+	if env.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(env.Timeout*float64(time.Second)))
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	if key, ok := forwardKey(req, req.Msg()); ok {
+		// cancelled by rpcmux.forward_cancel from the peer node
+		self.forwards.Store(key, cancel)
+		defer self.forwards.Delete(key)
+	}
+
+	router := self.GetRouter(env.Namespace)
+	if env.Id == nil {
+		ntfmsg := jsoff.NewNotifyMessage(env.Method, env.Params)
+		ntfmsg.SetTraceId(env.TraceId)
+		return router.Feed(ctx, ntfmsg)
+	}
+
+	reqmsg := jsoff.NewRequestMessage(env.Id, env.Method, env.Params)
+	reqmsg.SetTraceId(env.TraceId)
+	res, err := router.Feed(ctx, reqmsg)
+	if err != nil {
+		return nil, err
+	}
+	// unwrap the result so that the id of the forward request is kept
+	if resmsg, ok := res.(jsoff.Message); ok {
+		if resmsg.IsError() {
+			return nil, resmsg.MustError()
+		} else if resmsg.IsResult() {
+			return resmsg.MustResult(), nil
+		}
+	}
+	return res, nil
+}
+
+// forwardKey returns the key of a forwarded request by the link
+// session and the request id
+func forwardKey(req *jsoffnet.RPCRequest, msg jsoff.Message) (string, bool) {
+	session := req.Session()
+	if session == nil || !msg.IsRequest() {
+		return "", false
+	}
+	return fmt.Sprintf("%s:%v", session.SessionID(), msg.MustId()), true
+}
+
+// cancelForward cancels a request forwarded from the peer node, the
+// caller on the peer node has left
+func (self *App) cancelForward(req *jsoffnet.RPCRequest, params []interface{}) (interface{}, error) {
+	if !self.verifyNode(req) {
+		return nil, jsoff.ErrAuthFailed
+	}
+	session := req.Session()
+	if session == nil || len(params) == 0 {
+		return nil, nil
+	}
+	key := fmt.Sprintf("%s:%v", session.SessionID(), params[0])
+	if v, ok := self.forwards.LoadAndDelete(key); ok {
+		cancel, _ := v.(context.CancelFunc)
+		req.Log().Debugf("forwarded request %v cancelled by the peer node", params[0])
+		cancel()
+	}
+	return nil, nil
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"github.com/superisaac/jsoff"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPingInterval = time.Second * 30
+	defaultPingTimeout  = time.Second * 10
+	defaultMaxMissed    = 3
+)
+
+// keepaliveConfig returns the keepalive settings of the namespace,
+// the namespace specific ones precede
+func (self *Router) keepaliveConfig() KeepaliveConfig {
+	kc := KeepaliveConfig{}
+	for _, cfg := range self.App().Config.routerConfigs(self.namespace) {
+		if kc.Interval <= 0 {
+			kc.Interval = cfg.Keepalive.Interval
+		}
+		if kc.Timeout <= 0 {
+			kc.Timeout = cfg.Keepalive.Timeout
+		}
+		if kc.MaxMissed <= 0 {
+			kc.MaxMissed = cfg.Keepalive.MaxMissed
+		}
+	}
+	if kc.Interval <= 0 {
+		kc.Interval = defaultPingInterval
+	}
+	if kc.Timeout <= 0 {
+		kc.Timeout = defaultPingTimeout
+	}
+	if kc.MaxMissed <= 0 {
+		kc.MaxMissed = defaultMaxMissed
+	}
+	return kc
+}
+
+// keepalive pings the local services periodically, the half open
+// connections of dead workers are found by missed pings
+func (self *Router) keepalive(ctx context.Context) {
+	kc := self.keepaliveConfig()
+	ticker := time.NewTicker(kc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			self.serviceIndex.Range(func(k, v interface{}) bool {
+				sid, _ := k.(string)
+				service, _ := v.(*Service)
+				go self.pingService(ctx, sid, service, kc)
+				return true
+			})
+		}
+	}
+}
+
+// pingService pings a service and records the round trip time, the
+// service is dismissed after kc.MaxMissed missed pings in a row
+func (self *Router) pingService(rootCtx context.Context, sid string, service *Service, kc KeepaliveConfig) {
+	ctx, cancel := context.WithTimeout(rootCtx, kc.Timeout)
+	defer cancel()
+
+	pingmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), "_ping", nil)
+	start := time.Now()
+	res, err := self.requestService(ctx, service, pingmsg)
+	resmsg, ok := res.(jsoff.Message)
+	// any response but the timeout proves the worker alive
+	if ok && err == nil && !(resmsg.IsError() && resmsg.MustError().Code == jsoff.ErrTimeout.Code) {
+		atomic.StoreInt64(&service.rtt, int64(time.Since(start)))
+		atomic.StoreInt32(&service.missedPings, 0)
+		return
+	}
+	if rootCtx.Err() != nil {
+		// the router stops
+		return
+	}
+
+	missed := atomic.AddInt32(&service.missedPings, 1)
+	pingmsg.Log().Warnf("service %s missed %d pings", sid, missed)
+	if int(missed) >= kc.MaxMissed {
+		self.Log().Warnf("service %s is unresponsive, dismissed", sid)
+		// the session stays open, a stalled worker reconnects and
+		// declares again when told
+		if session := service.session; session != nil {
+			session.Send(jsoff.NewNotifyMessage("rpcmux.dismissed", nil))
+		}
+		self.DismissService(sid)
+	}
+}
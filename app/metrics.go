@@ -0,0 +1,54 @@
+package app
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric names
+const (
+	MetricReturnsViolations = "returns_violations"
+	MetricShadowRequests    = "shadow_requests"
+	MetricShadowMismatches  = "shadow_mismatches"
+)
+
+// routerMetrics holds the counters of a router by metric name and
+// method
+type routerMetrics struct {
+	counters sync.Map
+}
+
+func (self *routerMetrics) Incr(name string, method string) {
+	key := name + ":" + method
+	v, ok := self.counters.Load(key)
+	if !ok {
+		v, _ = self.counters.LoadOrStore(key, new(int64))
+	}
+	counter, _ := v.(*int64)
+	atomic.AddInt64(counter, 1)
+}
+
+func (self *routerMetrics) Get(name string, method string) int64 {
+	if v, ok := self.counters.Load(name + ":" + method); ok {
+		counter, _ := v.(*int64)
+		return atomic.LoadInt64(counter)
+	}
+	return 0
+}
+
+// Snapshot returns the counters as name => method => count
+func (self *routerMetrics) Snapshot() map[string]map[string]int64 {
+	snapshot := map[string]map[string]int64{}
+	self.counters.Range(func(k, v interface{}) bool {
+		key, _ := k.(string)
+		name, method, _ := strings.Cut(key, ":")
+		if _, ok := snapshot[name]; !ok {
+			snapshot[name] = map[string]int64{}
+		}
+		counter, _ := v.(*int64)
+		snapshot[name][method] = atomic.LoadInt64(counter)
+		return true
+	})
+	return snapshot
+}
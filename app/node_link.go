@@ -0,0 +1,273 @@
+package app
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/net"
+	"github.com/superisaac/rpcmux/backoff"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	linkMinBackoff = time.Millisecond * 100
+	linkMaxBackoff = time.Second * 10
+
+	// a notify waits as long for the link to a node to connect
+	linkNotifyTimeout = time.Second
+)
+
+var (
+	errLinkClosed = errors.New("node link closed")
+)
+
+// nodeLink is a persistent streaming connection to a peer node, the
+// messages forwarded to the node are multiplexed over it. The link
+// reconnects with backoff when the connection drops until it is
+// closed.
+type nodeLink struct {
+	serverUrl string
+	header    http.Header
+
+	ctx        context.Context
+	cancelFunc func()
+
+	lock   sync.Mutex
+	client jsoffnet.Streamable
+	// closed and renewed when the link connects
+	ready chan struct{}
+
+	// forwarded requests waiting for results
+	pendings sync.Map
+}
+
+// linkUrl turns the advertise url of a node to the url of a streaming
+// transport, http urls are linked by websocket as the h2c preface
+// carries no node secret through the auth handler, https urls are
+// served as h2 by the gateway handler
+func linkUrl(advUrl string) (string, error) {
+	u, err := url.Parse(advUrl)
+	if err != nil {
+		return "", errors.Wrap(err, "url.Parse")
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "h2"
+	case "h2", "h2c", "ws", "wss":
+	default:
+		return "", errors.Errorf("cannot link to node %s", advUrl)
+	}
+	return u.String(), nil
+}
+
+func newNodeLink(rootCtx context.Context, advUrl string, header http.Header) (*nodeLink, error) {
+	serverUrl, err := linkUrl(advUrl)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(rootCtx)
+	link := &nodeLink{
+		serverUrl:  serverUrl,
+		header:     header,
+		ctx:        ctx,
+		cancelFunc: cancel,
+		ready:      make(chan struct{}),
+	}
+	go link.run()
+	return link, nil
+}
+
+func (self *nodeLink) Log() *log.Entry {
+	return log.WithFields(log.Fields{
+		"link": self.serverUrl,
+	})
+}
+
+func (self *nodeLink) Connected() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.client != nil
+}
+
+func (self *nodeLink) Close() {
+	self.cancelFunc()
+}
+
+func (self *nodeLink) run() {
+	defer self.failPendings()
+	for attempt := 0; ; {
+		err := self.connect()
+		if err != nil {
+			self.Log().Warnf("link connect error, %s", err)
+			attempt++
+		} else {
+			attempt = 0
+		}
+		select {
+		case <-self.ctx.Done():
+			return
+		case <-time.After(backoff.Delay(attempt, linkMinBackoff, linkMaxBackoff)):
+		}
+	}
+}
+
+// connect connects to the node and waits until the connection closes
+func (self *nodeLink) connect() error {
+	c, err := jsoffnet.NewClient(self.serverUrl)
+	if err != nil {
+		return err
+	}
+	client, ok := c.(jsoffnet.Streamable)
+	if !ok {
+		return errors.New("client is not streamable")
+	}
+	client.SetExtraHeader(self.header)
+	client.OnMessage(self.handleMessage)
+	if err := client.Connect(self.ctx); err != nil {
+		return err
+	}
+	self.Log().Debugf("link connected")
+
+	self.lock.Lock()
+	self.client = client
+	close(self.ready)
+	self.lock.Unlock()
+
+	err = client.Wait()
+
+	self.lock.Lock()
+	self.client = nil
+	self.ready = make(chan struct{})
+	self.lock.Unlock()
+
+	self.Log().Debugf("link disconnected")
+	self.failPendings()
+	return err
+}
+
+func (self *nodeLink) failPendings() {
+	self.pendings.Range(func(k, v interface{}) bool {
+		if v, ok := self.pendings.LoadAndDelete(k); ok {
+			ch, _ := v.(chan jsoff.Message)
+			close(ch)
+		}
+		return true
+	})
+}
+
+// waitClient waits until the link connects
+func (self *nodeLink) waitClient(ctx context.Context) (jsoffnet.Streamable, error) {
+	for {
+		self.lock.Lock()
+		client, ready := self.client, self.ready
+		self.lock.Unlock()
+		if client != nil {
+			return client, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-self.ctx.Done():
+			return nil, errLinkClosed
+		case <-ready:
+		}
+	}
+}
+
+func (self *nodeLink) handleMessage(msg jsoff.Message) {
+	if !msg.IsResultOrError() {
+		msg.Log().Debugf("link dropped a non response message")
+		return
+	}
+	reqId, _ := msg.MustId().(string)
+	if v, ok := self.pendings.LoadAndDelete(reqId); ok {
+		ch, _ := v.(chan jsoff.Message)
+		ch <- msg
+	}
+}
+
+// Call sends a request over the link and waits for the result
+func (self *nodeLink) Call(ctx context.Context, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	client, err := self.waitClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reqId := jsoff.NewUuid()
+	ch := make(chan jsoff.Message, 1)
+	self.pendings.Store(reqId, ch)
+	defer self.pendings.Delete(reqId)
+
+	if err := client.Send(ctx, reqmsg.Clone(reqId)); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		// the node cancels the request on its side as well
+		cancelmsg := jsoff.NewNotifyMessage("rpcmux.forward_cancel", []interface{}{reqId})
+		if err := client.Send(self.ctx, cancelmsg); err != nil {
+			self.Log().Debugf("send forward cancel error, %s", err)
+		}
+		return nil, ctx.Err()
+	case resmsg, ok := <-ch:
+		if !ok {
+			return nil, errLinkClosed
+		}
+		return resmsg.ReplaceId(reqmsg.Id), nil
+	}
+}
+
+// Send sends a message over the link without waiting for any result
+func (self *nodeLink) Send(ctx context.Context, msg jsoff.Message) error {
+	client, err := self.waitClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Send(ctx, msg)
+}
+
+// linkRef counts the remote services sharing a link
+type linkRef struct {
+	link *nodeLink
+	refs int
+}
+
+// acquireLink returns the link to a peer node, a node pair keeps one
+// link however many namespaces they share
+func (self *App) acquireLink(advUrl string) (*nodeLink, error) {
+	self.linkLock.Lock()
+	defer self.linkLock.Unlock()
+
+	if self.links == nil {
+		self.links = make(map[string]*linkRef)
+	}
+	if ref, ok := self.links[advUrl]; ok {
+		ref.refs++
+		return ref.link, nil
+	}
+	link, err := newNodeLink(self.Context(), advUrl, self.nodeAuthHeader())
+	if err != nil {
+		return nil, err
+	}
+	self.links[advUrl] = &linkRef{link: link, refs: 1}
+	return link, nil
+}
+
+// releaseLink closes the link when no remote service uses it
+func (self *App) releaseLink(advUrl string) {
+	self.linkLock.Lock()
+	defer self.linkLock.Unlock()
+
+	if ref, ok := self.links[advUrl]; ok {
+		ref.refs--
+		if ref.refs <= 0 {
+			delete(self.links, advUrl)
+			ref.link.Close()
+		}
+	}
+}
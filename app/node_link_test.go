@@ -0,0 +1,263 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLinkUrl(t *testing.T) {
+	assert := assert.New(t)
+
+	u, err := linkUrl("http://127.0.0.1:6000")
+	assert.Nil(err)
+	assert.Equal("ws://127.0.0.1:6000", u)
+
+	u, err = linkUrl("https://node1.example.com")
+	assert.Nil(err)
+	assert.Equal("h2://node1.example.com", u)
+
+	u, err = linkUrl("ws://127.0.0.1:6000/ws")
+	assert.Nil(err)
+	assert.Equal("ws://127.0.0.1:6000/ws", u)
+
+	_, err = linkUrl("tcp://127.0.0.1:6000")
+	assert.NotNil(err)
+}
+
+func TestNodeLink(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	actor := jsoffnet.NewActor()
+	actor.OnTypedRequest("echo", func(req *jsoffnet.RPCRequest, text string) (string, error) {
+		r := httpRequest(req)
+		if r == nil || r.Header.Get("Authorization") != "Bearer nodesecret" {
+			return "", jsoff.ErrAuthFailed
+		}
+		return "echo: " + text, nil
+	})
+	handler := jsoffnet.NewGatewayHandler(rootCtx, actor, true)
+	go jsoffnet.ListenAndServe(rootCtx, "127.0.0.1:16061", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer nodesecret")
+	link, err := newNodeLink(rootCtx, "http://127.0.0.1:16061", h)
+	assert.Nil(err)
+
+	// concurrent calls are multiplexed over the link
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(rootCtx, time.Second)
+			defer cancel()
+			reqmsg := jsoff.NewRequestMessage(i, "echo", []interface{}{fmt.Sprintf("hi%d", i)})
+			resmsg, err := link.Call(ctx, reqmsg)
+			assert.Nil(err)
+			assert.True(resmsg.IsResult(), jsoff.MessageString(resmsg))
+			assert.Equal(i, resmsg.MustId())
+			if resmsg.IsResult() {
+				assert.Equal(fmt.Sprintf("echo: hi%d", i), resmsg.MustResult())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	link.Close()
+	_, err = link.Call(rootCtx, jsoff.NewRequestMessage(100, "echo", []interface{}{"hi"}))
+	assert.Equal(errLinkClosed, err)
+}
+
+func TestLinkWithAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgdata := `
+---
+server:
+  auth:
+    basic:
+      - username: user1
+        password: pwd1
+cluster:
+  secret: nodesecret
+`
+	app1 := NewApp()
+	defer app1.Stop()
+	assert.Nil(app1.Config.LoadYamldata([]byte(cfgdata)))
+	router1 := app1.GetRouter("default")
+
+	// app2 serves behind the auth handler
+	app2 := NewApp()
+	defer app2.Stop()
+	assert.Nil(app2.Config.LoadYamldata([]byte(cfgdata)))
+	_ = app2.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app2.Context(), NewActor(app2), true)
+	handler = jsoffnet.NewAuthHandler(app2.Config.Server.Auth, handler)
+	go jsoffnet.ListenAndServe(app2.Context(), "127.0.0.1:16271", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// a service of app2
+	c, err := jsoffnet.NewClient("ws://127.0.0.1:16271")
+	assert.Nil(err)
+	sc, _ := c.(jsoffnet.Streamable)
+	h := http.Header{}
+	h.Set("Authorization", "Basic dXNlcjE6cHdkMQ==")
+	sc.SetExtraHeader(h)
+	sc.OnMessage(func(msg jsoff.Message) {
+		if msg.IsRequest() && msg.MustMethod() == "echo" {
+			sc.Send(ctx, jsoff.NewResultMessage(msg, "echo: hi"))
+		}
+	})
+	assert.Nil(sc.Connect(ctx))
+	resmsg, err := sc.Call(ctx, jsoff.NewRequestMessage(1, "rpcmux.declare", []interface{}{map[string]interface{}{"echo": nil}}))
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+
+	// app1 forwards to app2 over the link
+	now := time.Now()
+	router1.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16271",
+		Methods:      []string{"echo"},
+		Timestamp:    now.Unix(),
+	}, now)
+	res, err := router1.Feed(ctx, jsoff.NewRequestMessage(2, "echo", []interface{}{"hi"}))
+	assert.Nil(err)
+	resmsg, _ = res.(jsoff.Message)
+	assert.True(resmsg.IsResult(), jsoff.MessageString(resmsg))
+	assert.Equal("echo: hi", resmsg.MustResult())
+}
+
+func TestForwardCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	app1 := NewApp()
+	defer app1.Stop()
+	app1.Config.Cluster.Breaker = BreakerConfig{MinCalls: 1}
+	router1 := app1.GetRouter("default")
+
+	app2 := NewApp()
+	defer app2.Stop()
+	_ = app2.GetRouter("default")
+	handler := jsoffnet.NewGatewayHandler(app2.Context(), NewActor(app2), true)
+	go jsoffnet.ListenAndServe(app2.Context(), "127.0.0.1:16291", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a service of app2 never answering slow
+	cancelled := make(chan interface{}, 1)
+	c, err := jsoffnet.NewClient("ws://127.0.0.1:16291")
+	assert.Nil(err)
+	sc, _ := c.(jsoffnet.Streamable)
+	sc.OnMessage(func(msg jsoff.Message) {
+		if msg.IsNotify() && msg.MustMethod() == "rpcmux.cancel" {
+			cancelled <- msg.MustParams()[0]
+		}
+	})
+	assert.Nil(sc.Connect(rootCtx))
+	resmsg, err := sc.Call(rootCtx, jsoff.NewRequestMessage(1, "rpcmux.declare", []interface{}{map[string]interface{}{"slow": nil}}))
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+
+	now := time.Now()
+	router1.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16291",
+		Methods:      []string{"slow"},
+		Timestamp:    now.Unix(),
+	}, now)
+
+	// the caller of app1 leaves before any deadline, app2 cancels
+	// the request on its service
+	callCtx, cancelCall := context.WithCancel(rootCtx)
+	defer cancelCall()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancelCall()
+	}()
+	_, err = router1.Feed(callCtx, jsoff.NewRequestMessage(2, "slow", []interface{}{}))
+	assert.NotNil(err)
+
+	select {
+	case reqId := <-cancelled:
+		assert.NotEmpty(reqId)
+	case <-time.After(time.Second):
+		assert.Fail("the remote request is not cancelled")
+	}
+
+	// the cancelled call is not a failure of app2
+	rsrv := router1.GetOrCreateRemoteService("http://127.0.0.1:16291")
+	assert.Equal(BreakerClosed, rsrv.breaker.State())
+}
+
+func TestForwardTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	app1 := NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Timeout = 200 * time.Millisecond
+	router1 := app1.GetRouter("default")
+
+	app2 := NewApp()
+	defer app2.Stop()
+	router2 := app2.GetRouter("default")
+	handler := jsoffnet.NewGatewayHandler(app2.Context(), NewActor(app2), true)
+	go jsoffnet.ListenAndServe(app2.Context(), "127.0.0.1:16301", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a service of app2 declaring a timeout longer than the default
+	// of app1
+	c, err := jsoffnet.NewClient("ws://127.0.0.1:16301")
+	assert.Nil(err)
+	sc, _ := c.(jsoffnet.Streamable)
+	sc.OnMessage(func(msg jsoff.Message) {
+		if msg.IsRequest() && msg.MustMethod() == "slow" {
+			reqmsg, _ := msg.(*jsoff.RequestMessage)
+			time.Sleep(500 * time.Millisecond)
+			sc.Send(rootCtx, jsoff.NewResultMessage(reqmsg, "done"))
+		}
+	})
+	assert.Nil(sc.Connect(rootCtx))
+	opts := map[string]interface{}{
+		"methods": map[string]interface{}{
+			"slow": map[string]interface{}{"timeout": 2},
+		},
+	}
+	resmsg, err := sc.Call(rootCtx, jsoff.NewRequestMessage(1, "rpcmux.declare", []interface{}{map[string]interface{}{"slow": nil}, opts}))
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+	assert.Equal(map[string]float64{"slow": 2}, router2.Timeouts())
+
+	now := time.Now()
+	router1.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16301",
+		Methods:      []string{"slow"},
+		Timeouts:     router2.Timeouts(),
+		Timestamp:    now.Unix(),
+	}, now)
+
+	// app1 waits as long as the worker of app2 declares
+	res, err := router1.Feed(rootCtx, jsoff.NewRequestMessage(2, "slow", []interface{}{}))
+	assert.Nil(err)
+	resmsg, _ = res.(jsoff.Message)
+	assert.True(resmsg.IsResult(), jsoff.MessageString(resmsg))
+	assert.Equal("done", resmsg.MustResult())
+}
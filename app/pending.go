@@ -0,0 +1,177 @@
+package app
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pendingHeap orders pending requests by expiration
+type pendingHeap []*pendingT
+
+func (self pendingHeap) Len() int {
+	return len(self)
+}
+
+func (self pendingHeap) Less(i, j int) bool {
+	return self[i].expiration.Before(self[j].expiration)
+}
+
+func (self pendingHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].index = i
+	self[j].index = j
+}
+
+func (self *pendingHeap) Push(x interface{}) {
+	pt, _ := x.(*pendingT)
+	pt.index = len(*self)
+	*self = append(*self, pt)
+}
+
+func (self *pendingHeap) Pop() interface{} {
+	old := *self
+	n := len(old)
+	pt := old[n-1]
+	old[n-1] = nil
+	pt.index = -1
+	*self = old[:n-1]
+	return pt
+}
+
+// pendingTable holds the requests sent to services and waiting for
+// results. Requests are indexed by id and by service, a single timer
+// fires at the nearest expiration, so adding, taking and expiring a
+// request cost O(log n) and dismissing a service costs O(k) where k is
+// the number of requests pending on that service.
+type pendingTable struct {
+	lock        sync.Mutex
+	items       map[string]*pendingT
+	byService   map[*Service]map[string]*pendingT
+	expirations pendingHeap
+	timer       *time.Timer
+
+	// called out of lock when a request expires
+	onExpire func(pt *pendingT)
+}
+
+func newPendingTable(onExpire func(pt *pendingT)) *pendingTable {
+	return &pendingTable{
+		items:     make(map[string]*pendingT),
+		byService: make(map[*Service]map[string]*pendingT),
+		onExpire:  onExpire,
+	}
+}
+
+func (self *pendingTable) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.items)
+}
+
+func (self *pendingTable) Add(pt *pendingT) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.items[pt.reqId] = pt
+	if pt.toService != nil {
+		srvItems, ok := self.byService[pt.toService]
+		if !ok {
+			srvItems = make(map[string]*pendingT)
+			self.byService[pt.toService] = srvItems
+		}
+		srvItems[pt.reqId] = pt
+		atomic.AddInt64(&pt.toService.pending, 1)
+	}
+	heap.Push(&self.expirations, pt)
+	if pt.index == 0 {
+		// the nearest expiration changed
+		self.resetTimer()
+	}
+}
+
+func (self *pendingTable) Take(reqId string) (*pendingT, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	pt, ok := self.items[reqId]
+	if !ok {
+		return nil, false
+	}
+	self.remove(pt)
+	if pt.index >= 0 {
+		heap.Remove(&self.expirations, pt.index)
+	}
+	return pt, true
+}
+
+// TakeService removes and returns all requests pending on a service
+func (self *pendingTable) TakeService(service *Service) []*pendingT {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	srvItems, ok := self.byService[service]
+	if !ok {
+		return nil
+	}
+	taken := make([]*pendingT, 0, len(srvItems))
+	for _, pt := range srvItems {
+		taken = append(taken, pt)
+	}
+	for _, pt := range taken {
+		self.remove(pt)
+		if pt.index >= 0 {
+			heap.Remove(&self.expirations, pt.index)
+		}
+	}
+	return taken
+}
+
+// remove unlinks a request from the indices but the heap, must be
+// called within lock
+func (self *pendingTable) remove(pt *pendingT) {
+	delete(self.items, pt.reqId)
+	if pt.toService != nil {
+		if srvItems, ok := self.byService[pt.toService]; ok {
+			delete(srvItems, pt.reqId)
+			if len(srvItems) == 0 {
+				delete(self.byService, pt.toService)
+			}
+		}
+		atomic.AddInt64(&pt.toService.pending, -1)
+	}
+}
+
+// resetTimer arms the timer at the nearest expiration, must be called
+// within lock
+func (self *pendingTable) resetTimer() {
+	if len(self.expirations) == 0 {
+		return
+	}
+	after := time.Until(self.expirations[0].expiration)
+	if self.timer == nil {
+		self.timer = time.AfterFunc(after, self.expire)
+	} else {
+		self.timer.Stop()
+		self.timer.Reset(after)
+	}
+}
+
+func (self *pendingTable) expire() {
+	now := time.Now()
+	expired := []*pendingT{}
+
+	self.lock.Lock()
+	for len(self.expirations) > 0 && !self.expirations[0].expiration.After(now) {
+		pt, _ := heap.Pop(&self.expirations).(*pendingT)
+		self.remove(pt)
+		expired = append(expired, pt)
+	}
+	self.resetTimer()
+	self.lock.Unlock()
+
+	for _, pt := range expired {
+		self.onExpire(pt)
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jsoff"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestPending(reqId string, service *Service, after time.Duration) *pendingT {
+	return &pendingT{
+		reqId:         reqId,
+		orig:          jsoff.NewRequestMessage(reqId, "echo", nil),
+		resultChannel: make(chan jsoff.Message, 10),
+		toService:     service,
+		expiration:    time.Now().Add(after),
+	}
+}
+
+func TestPendingTable(t *testing.T) {
+	assert := assert.New(t)
+
+	expired := make(chan string, 10)
+	table := newPendingTable(func(pt *pendingT) {
+		expired <- pt.reqId
+	})
+
+	srv1 := &Service{}
+	srv2 := &Service{}
+	table.Add(newTestPending("a", srv1, 100*time.Millisecond))
+	table.Add(newTestPending("b", srv1, 20*time.Millisecond))
+	table.Add(newTestPending("c", srv2, 50*time.Millisecond))
+	table.Add(newTestPending("d", srv2, time.Minute))
+	assert.Equal(4, table.Len())
+	assert.Equal(int64(2), srv1.Pending())
+
+	pt, ok := table.Take("a")
+	assert.True(ok)
+	assert.Equal("a", pt.reqId)
+	_, ok = table.Take("a")
+	assert.False(ok)
+
+	// expired by the order of expiration
+	assert.Equal("b", <-expired)
+	assert.Equal("c", <-expired)
+	assert.Equal(int64(0), srv1.Pending())
+
+	taken := table.TakeService(srv2)
+	assert.Equal(1, len(taken))
+	assert.Equal("d", taken[0].reqId)
+	assert.Equal(0, table.Len())
+	assert.Equal(0, len(table.expirations))
+}
+
+// the approach before pendingTable, a sync.Map and one goroutine
+// sleeping the whole timeout per request
+func BenchmarkPendingGoroutines(b *testing.B) {
+	var pendings sync.Map
+	srv := &Service{}
+	for i := 0; i < b.N; i++ {
+		reqId := fmt.Sprintf("r%d", i)
+		pt := newTestPending(reqId, srv, time.Second)
+		pendings.Store(reqId, pt)
+		go func(reqId string) {
+			time.Sleep(time.Second)
+			pendings.LoadAndDelete(reqId)
+		}(reqId)
+		pendings.LoadAndDelete(reqId)
+	}
+}
+
+func BenchmarkPendingTable(b *testing.B) {
+	table := newPendingTable(func(pt *pendingT) {})
+	srv := &Service{}
+	for i := 0; i < b.N; i++ {
+		reqId := fmt.Sprintf("r%d", i)
+		pt := newTestPending(reqId, srv, time.Second)
+		table.Add(pt)
+		table.Take(reqId)
+	}
+}
+
+const benchPendings = 10000
+
+// dismissing a service by scanning all pendings
+func BenchmarkDismissScan(b *testing.B) {
+	services := make([]*Service, 100)
+	for i := range services {
+		services[i] = &Service{}
+	}
+	var pendings sync.Map
+	for i := 0; i < benchPendings; i++ {
+		reqId := fmt.Sprintf("r%d", i)
+		pendings.Store(reqId, newTestPending(reqId, services[i%len(services)], time.Minute))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := services[i%len(services)]
+		found := 0
+		pendings.Range(func(k, v interface{}) bool {
+			pt, _ := v.(*pendingT)
+			if pt.toService == target {
+				found++
+			}
+			return true
+		})
+	}
+}
+
+// dismissing a service by the service index
+func BenchmarkDismissIndex(b *testing.B) {
+	services := make([]*Service, 100)
+	for i := range services {
+		services[i] = &Service{}
+	}
+	table := newPendingTable(func(pt *pendingT) {})
+	for i := 0; i < benchPendings; i++ {
+		reqId := fmt.Sprintf("r%d", i)
+		table.Add(newTestPending(reqId, services[i%len(services)], time.Minute))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := services[i%len(services)]
+		// take and put them back to keep the table size
+		taken := table.TakeService(target)
+		b.StopTimer()
+		for _, pt := range taken {
+			table.Add(pt)
+		}
+		b.StartTimer()
+	}
+}
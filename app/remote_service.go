@@ -2,20 +2,85 @@ package app
 
 import (
 	log "github.com/sirupsen/logrus"
-	"github.com/superisaac/jsoff/net"
-	"math/rand"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
-func (self *RemoteService) Client() jsoffnet.Client {
-	if self.client == nil {
-		c, err := jsoffnet.NewClient(self.AdvertiseUrl)
+// Link returns the link to the remote node
+func (self *RemoteService) Link() (*nodeLink, error) {
+	self.linkLock.Lock()
+	defer self.linkLock.Unlock()
+	if self.link == nil {
+		link, err := self.app.acquireLink(self.AdvertiseUrl)
 		if err != nil {
-			log.Panicf("error create remote client: %s", err)
+			return nil, err
 		}
-		self.client = c
+		self.link = link
 	}
-	return self.client
+	return self.link, nil
+}
+
+// Close releases the link to the remote node
+func (self *RemoteService) Close() {
+	self.linkLock.Lock()
+	defer self.linkLock.Unlock()
+	if self.link != nil {
+		self.link = nil
+		self.app.releaseLink(self.AdvertiseUrl)
+	}
+}
+
+const (
+	defaultLeaseTTL      = time.Minute * 2
+	defaultSweepInterval = time.Second * 10
+)
+
+func (self *RemoteService) Pending() int64 {
+	return atomic.LoadInt64(&self.pending)
+}
+
+// Weight returns the sum of the weights of the services of the node,
+// 1 if the node publishes no services
+func (self *RemoteService) Weight() int {
+	total := 0
+	for _, summary := range self.Services {
+		if summary.Weight > 0 {
+			total += summary.Weight
+		}
+	}
+	if total <= 0 {
+		return 1
+	}
+	return total
+}
+
+// MethodWeight returns the sum of the weights of the services of the
+// node serving the method, weights configured by label selectors
+// override the declared ones
+func (self *RemoteService) MethodWeight(method string, weights []labelWeight) int {
+	total := 0
+	for _, summary := range self.Services {
+		if stringInList(method, summary.Methods) {
+			if w := weightByLabels(weights, summary.Labels, summary.Weight); w > 0 {
+				total += w
+			}
+		}
+	}
+	if total <= 0 {
+		return 1
+	}
+	return total
+}
+
+// Timeout returns the longest timeout of a method declared by the
+// services of the node
+func (self *RemoteService) Timeout(method string) (time.Duration, bool) {
+	t, ok := self.Timeouts[method]
+	if !ok || t <= 0 {
+		return 0, false
+	}
+	return time.Duration(t * float64(time.Second)), true
 }
 
 func (self *RemoteService) UpdateStatus(newStatus serviceStatus) ([]string, []string) {
@@ -44,24 +109,81 @@ func (self *RemoteService) UpdateStatus(newStatus serviceStatus) ([]string, []st
 		}
 	}
 	self.Methods = newMethods
+	self.Deliveries = newStatus.Deliveries
+	self.Schemas = newStatus.Schemas
+	self.Versions = newStatus.Versions
+	self.Timeouts = newStatus.Timeouts
+	self.Services = newStatus.Services
 	self.AdvertiseUrl = newStatus.AdvertiseUrl
 	self.UpdateAt = time.Unix(newStatus.Timestamp, 0)
 	return removed, added
 }
 
+// renewLease extends the lease from the time the status is sent
+func (self *RemoteService) renewLease(ttl time.Duration) {
+	if expiry := self.UpdateAt.Add(ttl); expiry.After(self.leaseExpiry) {
+		self.leaseExpiry = expiry
+	}
+}
+
+func (self *App) leaseTTL() time.Duration {
+	if self.Config.Cluster.LeaseTTL > 0 {
+		return self.Config.Cluster.LeaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+func (self *App) sweepInterval() time.Duration {
+	if self.Config.Cluster.SweepInterval > 0 {
+		return self.Config.Cluster.SweepInterval
+	}
+	return defaultSweepInterval
+}
+
 // remote services methods
 func (self *Router) GetOrCreateRemoteService(advUrl string) *RemoteService {
 	if v, ok := self.remoteServiceIndex.Load(advUrl); ok {
 		rsrv, _ := v.(*RemoteService)
 		return rsrv
 	} else {
-		newsrv := &RemoteService{AdvertiseUrl: advUrl}
+		newsrv := &RemoteService{
+			AdvertiseUrl: advUrl,
+			app:          self.App(),
+			breaker:      newCircuitBreaker(self.App().Config.Cluster.Breaker),
+		}
 		v, _ := self.remoteServiceIndex.LoadOrStore(advUrl, newsrv)
 		rsrv, _ := v.(*RemoteService)
 		return rsrv
 	}
 }
 
+// removeRemoteService unlinks a remote node that leaves or expires
+func (self *Router) removeRemoteService(rsrv *RemoteService) {
+	self.remoteServiceIndex.Delete(rsrv.AdvertiseUrl)
+	removed := []string{}
+	for mname, _ := range rsrv.Methods {
+		removed = append(removed, mname)
+	}
+	self.UpdateRemoteService(rsrv, removed, nil)
+	rsrv.Close()
+}
+
+// sweepLeases removes the remote nodes whose leases expire
+func (self *Router) sweepLeases(now time.Time) {
+	expired := []*RemoteService{}
+	self.remoteServiceIndex.Range(func(k, v interface{}) bool {
+		rsrv, _ := v.(*RemoteService)
+		if now.After(rsrv.leaseExpiry) {
+			expired = append(expired, rsrv)
+		}
+		return true
+	})
+	for _, rsrv := range expired {
+		self.Log().Infof("lease of remote node %s expired at %s, remove %d methods", rsrv.AdvertiseUrl, rsrv.leaseExpiry, len(rsrv.Methods))
+		self.removeRemoteService(rsrv)
+	}
+}
+
 func (self *Router) AddRemote(method string, service *RemoteService) {
 	self.remoteServiceLock.Lock()
 	defer self.remoteServiceLock.Unlock()
@@ -109,19 +231,78 @@ func (self *Router) UpdateRemoteService(service *RemoteService, removed []string
 	for _, mname := range added {
 		self.AddRemote(mname, service)
 	}
+	self.notifyServicesChanged()
 }
 
 func (self *Router) SelectRemoteService(method string) (*RemoteService, bool) {
+	return self.selectRemoteService(method, nil)
+}
+
+func (self *Router) selectRemoteService(method string, crit *selectCriteria) (*RemoteService, bool) {
 	self.remoteServiceLock.RLock()
 	defer self.remoteServiceLock.RUnlock()
 
 	if remoteServices, ok := self.methodRemoteServices[method]; ok && len(remoteServices) > 0 {
-		idx := rand.Intn(len(remoteServices))
-		return remoteServices[idx], true
+		candidates := make([]*RemoteService, 0, len(remoteServices))
+		targets := make([]BalanceTarget, 0, len(remoteServices))
+		weights := self.configuredWeights(method)
+		for _, rsrv := range remoteServices {
+			if crit.accept(method, rsrv) && rsrv.breaker.Available() {
+				candidates = append(candidates, rsrv)
+				targets = append(targets, weightedTarget{rsrv, rsrv.MethodWeight(method, weights)})
+			}
+		}
+		if len(candidates) > 0 {
+			idx := self.balancer("remote", method).Select(targets)
+			return candidates[idx], true
+		}
 	}
 	return nil, false
 }
 
+// BreakerStatus returns the circuit breaker status of remote nodes
+func (self *Router) BreakerStatus() []map[string]interface{} {
+	statusList := []map[string]interface{}{}
+	self.remoteServiceIndex.Range(func(k, v interface{}) bool {
+		rsrv, _ := v.(*RemoteService)
+		st := rsrv.breaker.Status()
+		st["advertise_url"] = rsrv.AdvertiseUrl
+		statusList = append(statusList, st)
+		return true
+	})
+	return statusList
+}
+
+// NodesInfo returns the remote nodes known to the namespace and their
+// health
+func (self *Router) NodesInfo() []map[string]interface{} {
+	infoList := []map[string]interface{}{}
+	self.remoteServiceIndex.Range(func(k, v interface{}) bool {
+		rsrv, _ := v.(*RemoteService)
+		methods := []string{}
+		for mname, _ := range rsrv.Methods {
+			methods = append(methods, mname)
+		}
+		sort.Strings(methods)
+
+		rsrv.linkLock.Lock()
+		connected := rsrv.link != nil && rsrv.link.Connected()
+		rsrv.linkLock.Unlock()
+
+		infoList = append(infoList, map[string]interface{}{
+			"advertise_url": rsrv.AdvertiseUrl,
+			"update_at":     rsrv.UpdateAt.UTC().Unix(),
+			"lease_expiry":  rsrv.leaseExpiry.UTC().Unix(),
+			"methods":       methods,
+			"pending":       rsrv.Pending(),
+			"breaker":       rsrv.breaker.State(),
+			"connected":     connected,
+		})
+		return true
+	})
+	return infoList
+}
+
 func (self *Router) RemoteMethods() []string {
 	self.remoteServiceLock.RLock()
 	defer self.remoteServiceLock.RUnlock()
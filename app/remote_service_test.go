@@ -0,0 +1,75 @@
+package app
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRemoteLeases(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+	app.Config.Cluster.LeaseTTL = time.Minute
+
+	router := NewRouter("default")
+	router.app = app
+
+	now := time.Now()
+	router.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16071",
+		Methods:      []string{"echo", "add"},
+		Timestamp:    now.Unix(),
+	}, now)
+	router.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16072",
+		Methods:      []string{"echo"},
+		Timestamp:    now.Add(-time.Second * 30).Unix(),
+	}, now)
+
+	// a status older than the ttl is ignored
+	router.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16073",
+		Methods:      []string{"echo"},
+		Timestamp:    now.Add(-time.Minute * 2).Unix(),
+	}, now)
+	assert.ElementsMatch([]string{"echo", "add"}, router.RemoteMethods())
+	assert.Equal(2, len(router.methodRemoteServices["echo"]))
+
+	// the lease of 16072 expires
+	router.sweepLeases(now.Add(time.Second * 45))
+	assert.Equal(1, len(router.methodRemoteServices["echo"]))
+	_, ok := router.remoteServiceIndex.Load("http://127.0.0.1:16072")
+	assert.False(ok)
+
+	// a status renews the lease of 16071
+	router.applyStatus(serviceStatus{
+		AdvertiseUrl: "http://127.0.0.1:16071",
+		Methods:      []string{"echo"},
+		Timestamp:    now.Add(time.Second * 50).Unix(),
+	}, now.Add(time.Second*50))
+	router.sweepLeases(now.Add(time.Second * 90))
+	assert.Equal([]string{"echo"}, router.RemoteMethods())
+
+	router.sweepLeases(now.Add(time.Second * 120))
+	assert.Equal([]string{}, router.RemoteMethods())
+}
+
+func TestRemoteWeights(t *testing.T) {
+	assert := assert.New(t)
+
+	rsrv := &RemoteService{}
+	assert.Equal(1, rsrv.Weight())
+	assert.Equal(1, rsrv.MethodWeight("echo", nil))
+
+	rsrv.Services = []serviceSummary{
+		{Methods: []string{"echo", "add"}, Weight: 3},
+		{Methods: []string{"echo"}, Weight: 2},
+		{Methods: []string{"add"}, Weight: 4},
+	}
+	assert.Equal(9, rsrv.Weight())
+	assert.Equal(5, rsrv.MethodWeight("echo", nil))
+	assert.Equal(7, rsrv.MethodWeight("add", nil))
+	assert.Equal(1, rsrv.MethodWeight("sub", nil))
+}
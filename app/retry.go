@@ -0,0 +1,50 @@
+package app
+
+import (
+	"github.com/superisaac/jsoff"
+	"time"
+)
+
+// retryPolicy returns the retry policy of a method, nil if the method
+// is not idempotent or no policy is configured
+func (self *Router) retryPolicy(method string) *RetryConfig {
+	appcfg := self.App().Config
+	idempotent := lookupMethodSetting(appcfg, self.namespace, method, func(m *MethodConfig) *bool {
+		return m.Idempotent
+	})
+	if idempotent == nil || !*idempotent {
+		return nil
+	}
+	return lookupMethodSetting(appcfg, self.namespace, method, func(m *MethodConfig) *RetryConfig {
+		return m.Retry
+	})
+}
+
+// shouldRetry tells whether the result of an attempt is worth
+// retrying, transport errors, service gone and worker busy errors are
+// always retryable
+func (self RetryConfig) shouldRetry(res interface{}, err error) bool {
+	if err != nil {
+		return true
+	}
+	if errmsg, ok := res.(*jsoff.ErrorMessage); ok {
+		code := errmsg.MustError().Code
+		if code == ErrServiceGone.Code || code == ErrWorkerBusy.Code {
+			return true
+		}
+		for _, c := range self.Codes {
+			if c == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backoff returns the duration to wait after the nth attempt failed
+func (self RetryConfig) backoff(attempt int) time.Duration {
+	if self.Backoff <= 0 || attempt < 1 {
+		return 0
+	}
+	return self.Backoff << (attempt - 1)
+}
@@ -2,21 +2,33 @@ package app
 
 import (
 	"context"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jsoff"
 	"github.com/superisaac/jsoff/net"
 	"github.com/superisaac/rpcmux/mq"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultRequestTimeout = time.Second * 10
+
+	// service changes within the delay are published once
+	publishDebounce = time.Millisecond * 100
+)
+
 func NewRouter(ns string) *Router {
-	return &Router{
+	router := &Router{
 		namespace:            ns,
 		mqSection:            "ns:" + ns,
 		methodServicesIndex:  make(map[string][]*Service),
 		methodRemoteServices: make(map[string][]*RemoteService),
+		metrics:              &routerMetrics{},
 	}
+	router.pendings = newPendingTable(router.expirePending)
+	return router
 }
 
 func (self *Router) App() *App {
@@ -33,6 +45,8 @@ func (self *Router) Start() {
 }
 
 func (self *Router) Stop() {
+	self.ctxLock.Lock()
+	defer self.ctxLock.Unlock()
 	if self.cancelFunc != nil {
 		self.cancelFunc()
 		self.cancelFunc = nil
@@ -41,6 +55,14 @@ func (self *Router) Stop() {
 	}
 }
 
+// runContext returns the context of the running router, nil if the
+// router is not running
+func (self *Router) runContext() context.Context {
+	self.ctxLock.Lock()
+	defer self.ctxLock.Unlock()
+	return self.ctx
+}
+
 func (self *Router) Log() *log.Entry {
 	return log.WithFields(log.Fields{
 		"advurl":    self.App().Config.Server.AdvertiseUrl,
@@ -70,22 +92,10 @@ func (self *Router) DismissService(sid string) bool {
 		// unlink methods
 		service.UpdateMethods(nil)
 
-		// send pending timeouts
-		removing := []interface{}{}
-		self.pendings.Range(func(k, v interface{}) bool {
-			pt, _ := v.(*pendingT)
-			if pt.toService == service {
-				removing = append(removing, k)
-			}
-			return true
-		})
-		for _, k := range removing {
-			if v, ok := self.pendings.LoadAndDelete(k); ok {
-				// return a timeout messsage
-				pt, _ := v.(*pendingT)
-				timeout := jsoff.ErrTimeout.ToMessage(pt.orig)
-				pt.resultChannel <- timeout
-			}
+		// fail the pending requests, idempotent methods are
+		// retried on other services
+		for _, pt := range self.pendings.TakeService(service) {
+			pt.resultChannel <- ErrServiceGone.ToMessage(pt.orig)
 		}
 
 		// dismiss the service
@@ -96,66 +106,275 @@ func (self *Router) DismissService(sid string) bool {
 	}
 }
 
-func (self *Router) checkExpire(reqId string, after time.Duration) {
-	time.Sleep(after)
-	if v, ok := self.pendings.LoadAndDelete(reqId); ok {
-		pt, _ := v.(*pendingT)
-		pt.orig.Log().Infof("request timeout ")
-		pt.resultChannel <- jsoff.ErrTimeout.ToMessage(pt.orig)
+func (self *Router) expirePending(pt *pendingT) {
+	pt.orig.Log().Infof("request timeout, %s limit %s", pt.limit, pt.timeout)
+	self.cancelPending(pt)
+	pt.resultChannel <- timeoutError(pt.limit, pt.timeout).ToMessage(pt.orig)
+}
+
+// timeoutSource declares the timeouts of methods, a local service or
+// a remote node publishing the timeouts of its services
+type timeoutSource interface {
+	Timeout(method string) (time.Duration, bool)
+}
+
+// requestTimeout returns the timeout of a request and the limit it
+// comes from. The server wide default applies only when neither the
+// method config nor the worker declares a timeout, then the smallest
+// one of the method, worker and caller timeouts wins.
+func (self *Router) requestTimeout(ctx context.Context, declared timeoutSource, method string) (time.Duration, string) {
+	timeout := time.Duration(0)
+	limit := ""
+
+	cfgs := self.App().Config.routerConfigs(self.namespace)
+	for _, cfg := range cfgs {
+		if mcfg, ok := cfg.Methods[method]; ok && mcfg != nil && mcfg.Timeout > 0 {
+			timeout, limit = mcfg.Timeout, TimeoutByMethod
+			break
+		}
+	}
+
+	if declared != nil {
+		if t, ok := declared.Timeout(method); ok && (limit == "" || t < timeout) {
+			timeout, limit = t, TimeoutByWorker
+		}
+	}
+
+	if limit == "" {
+		timeout, limit = defaultRequestTimeout, TimeoutByDefault
+		for _, cfg := range cfgs {
+			if cfg.Timeout > 0 {
+				timeout = cfg.Timeout
+				break
+			}
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if t := time.Until(deadline); t < timeout {
+			timeout, limit = t, TimeoutByCaller
+		}
+	}
+	return timeout, limit
+}
+
+func (self *Router) handleRequestMessage(ctx context.Context, reqmsg *jsoff.RequestMessage) (res interface{}, err error) {
+	crit := &selectCriteria{
+		tried:    map[BalanceTarget]bool{},
+		version:  versionConstraintFrom(ctx),
+		hashKey:  hashKeyFrom(ctx),
+		selector: selectorFrom(ctx),
+		schema:   schemaHashFrom(ctx),
+	}
+	if grace := self.serviceGrace(reqmsg.Method); !self.waitProvider(ctx, reqmsg.Method, crit, grace) {
+		if grace > 0 {
+			return noProviderError(reqmsg.Method, grace).ToMessage(reqmsg), nil
+		}
+		return jsoff.ErrMethodNotFound.ToMessage(reqmsg), nil
+	}
+	if err := self.checkParams(reqmsg, crit); err != nil {
+		return err.ToMessage(reqmsg), nil
+	}
+
+	if primaryChannel := self.startShadow(ctx, reqmsg, crit); primaryChannel != nil {
+		defer func() {
+			primaryChannel <- res
+		}()
+	}
+
+	policy := self.retryPolicy(reqmsg.Method)
+
+	for attempt := 1; ; attempt++ {
+		var target BalanceTarget
+		if service, ok := self.selectService(reqmsg.Method, crit); ok {
+			target = service
+			res, err = self.requestService(ctx, service, reqmsg)
+		} else if rsrv, ok := self.selectRemoteFor(ctx, reqmsg.Method, crit); ok {
+			target = rsrv
+			res, err = self.requestRemoteService(ctx, rsrv, reqmsg)
+		} else if attempt == 1 {
+			return jsoff.ErrMethodNotFound.ToMessage(reqmsg), nil
+		} else {
+			// no more services to retry
+			return res, err
+		}
+
+		if policy == nil || attempt >= policy.MaxAttempts || !policy.shouldRetry(res, err) {
+			return res, err
+		}
+		crit.tried[target] = true
+		reqmsg.Log().Infof("attempt %d failed, retry on another service", attempt)
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(policy.backoff(attempt)):
+		}
+	}
+}
+
+// selectRemoteFor selects a remote service unless the message in ctx
+// has been forwarded too many times
+func (self *Router) selectRemoteFor(ctx context.Context, method string, crit *selectCriteria) (*RemoteService, bool) {
+	if forwardHops(ctx) >= self.App().maxHops() {
+		return nil, false
 	}
+	return self.selectRemoteService(method, crit)
 }
 
-func (self *Router) handleRequestMessage(reqmsg *jsoff.RequestMessage) (interface{}, error) {
-	if service, ok := self.SelectService(reqmsg.Method); ok {
-		return self.requestService(service, reqmsg)
-	} else if rsrv, ok := self.SelectRemoteService(reqmsg.Method); ok {
+func (self *Router) requestRemoteService(rootCtx context.Context, rsrv *RemoteService, reqmsg *jsoff.RequestMessage) (interface{}, error) {
+	expireAfter, limit := self.requestTimeout(rootCtx, rsrv, reqmsg.Method)
+	ctx, cancel := context.WithTimeout(rootCtx, expireAfter)
+	defer cancel()
+
+	// only the caller's deadline is forwarded, the peer node applies
+	// its own method and worker timeouts
+	callerTimeout := time.Duration(0)
+	if deadline, ok := rootCtx.Deadline(); ok {
+		callerTimeout = time.Until(deadline)
+	}
+
+	link, err := rsrv.Link()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&rsrv.pending, 1)
+	defer atomic.AddInt64(&rsrv.pending, -1)
+
+	env := self.newForwardEnvelope(rootCtx, reqmsg, callerTimeout)
+	fwdmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), "rpcmux.forward", []interface{}{env})
 
-		// select remote service
-		c := rsrv.Client()
-		resmsg, err := c.Call(context.Background(), reqmsg)
-		return resmsg, err
+	rsrv.breaker.Begin()
+	start := time.Now()
+	resmsg, err := link.Call(ctx, fwdmsg)
+	if err == nil || rootCtx.Err() == nil {
+		rsrv.breaker.Record(err != nil, time.Since(start))
 	} else {
-		return jsoff.ErrMethodNotFound.ToMessage(reqmsg), nil
+		// the caller cancels or times out, not a failure of the node
+		rsrv.breaker.Skip()
+	}
+
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reqmsg.Log().Infof("remote request timeout, %s limit %s", limit, expireAfter)
+			return timeoutError(limit, expireAfter).ToMessage(reqmsg), nil
+		}
+		return nil, err
+	}
+	// restore the id of the original request
+	if resmsg.IsResult() {
+		return jsoff.NewResultMessage(reqmsg, resmsg.MustResult()), nil
+	} else {
+		return jsoff.NewErrorMessage(reqmsg, resmsg.MustError()), nil
+	}
+}
+
+func (self *Router) notifyRemoteService(rootCtx context.Context, rsrv *RemoteService, ntfmsg *jsoff.NotifyMessage) error {
+	link, err := rsrv.Link()
+	if err != nil {
+		return err
 	}
+	env := self.newForwardEnvelope(rootCtx, ntfmsg, 0)
+	fwdmsg := jsoff.NewNotifyMessage("rpcmux.forward", []interface{}{env})
+
+	// an unreachable node holds the notify no longer than
+	// linkNotifyTimeout
+	ctx, cancel := context.WithTimeout(rootCtx, linkNotifyTimeout)
+	defer cancel()
+	return link.Send(ctx, fwdmsg)
 }
 
-func (self *Router) requestService(service *Service, reqmsg *jsoff.RequestMessage) (interface{}, error) {
+func (self *Router) requestService(ctx context.Context, service *Service, reqmsg *jsoff.RequestMessage) (interface{}, error) {
 	resultChannel := make(chan jsoff.Message, 10)
-	expireAfter := time.Second * 10
+	expireAfter, limit := self.requestTimeout(ctx, service, reqmsg.Method)
+	reqId := jsoff.NewUuid()
 	pt := &pendingT{
+		reqId:         reqId,
 		orig:          reqmsg,
 		resultChannel: resultChannel,
 		toService:     service,
 		expiration:    time.Now().Add(expireAfter),
+		timeout:       expireAfter,
+		limit:         limit,
 	}
-	reqId := jsoff.NewUuid()
 	reqmsg = reqmsg.Clone(reqId)
 
+	// add to pendings before sending, the result may come back
+	// before Send() returns
+	self.pendings.Add(pt)
 	err := service.Send(reqmsg)
 	if err != nil {
+		self.pendings.Take(reqId)
 		return nil, err
 	}
-	self.pendings.Store(reqId, pt)
-	go self.checkExpire(reqId, expireAfter)
-	resmsg := <-resultChannel
-	return resmsg, nil
+	select {
+	case resmsg := <-resultChannel:
+		return resmsg, nil
+	case <-ctx.Done():
+		if pt, ok := self.pendings.Take(reqId); ok {
+			// the caller is gone, the result is no more wanted
+			reqmsg.Log().Infof("request cancelled, %s", ctx.Err())
+			self.cancelPending(pt)
+			return nil, ctx.Err()
+		}
+		// the result or the expiration comes at the same time
+		return <-resultChannel, nil
+	}
+}
+
+// cancelPending tells the service to cancel a pending request
+func (self *Router) cancelPending(pt *pendingT) {
+	if pt.toService == nil {
+		return
+	}
+	session := pt.toService.session
+	if session == nil {
+		// the service is dismissed
+		return
+	}
+	ntfmsg := jsoff.NewNotifyMessage("rpcmux.cancel", []interface{}{pt.reqId})
+	ntfmsg.SetTraceId(pt.orig.TraceId())
+	session.Send(ntfmsg)
 }
 
-func (self *Router) handleNotifyMessage(ntfmsg *jsoff.NotifyMessage) (interface{}, error) {
-	if service, ok := self.SelectService(ntfmsg.Method); ok {
+func (self *Router) handleNotifyMessage(ctx context.Context, ntfmsg *jsoff.NotifyMessage) (interface{}, error) {
+	crit := &selectCriteria{
+		version:  versionConstraintFrom(ctx),
+		hashKey:  hashKeyFrom(ctx),
+		selector: selectorFrom(ctx),
+		schema:   schemaHashFrom(ctx),
+	}
+	if err := self.checkParams(ntfmsg, crit); err != nil {
+		ntfmsg.Log().Warnf("invalid params, dropped, %s", err.Message)
+		return nil, nil
+	}
+
+	mode := self.deliveryMode(ntfmsg.Method)
+	if mode == DeliveryBroadcast {
+		self.broadcast(ctx, ntfmsg, crit)
+		return nil, nil
+	}
+
+	if service, ok := self.selectService(ntfmsg.Method, crit); ok {
 		err := service.Send(ntfmsg)
 		return nil, err
+	} else if mode != DeliveryAny {
+		ntfmsg.Log().Debugf("no local service, dropped")
+	} else if rsrv, ok := self.selectRemoteFor(ctx, ntfmsg.Method, crit); ok {
+		return nil, self.notifyRemoteService(ctx, rsrv, ntfmsg)
 	} else {
-		ntfmsg.Log().Debugf("delivered")
+		ntfmsg.Log().Debugf("no local or remote service, dropped")
 	}
 	return nil, nil
 }
 
 func (self *Router) handleResultOrError(msg jsoff.Message) (interface{}, error) {
-	if v, ok := self.pendings.LoadAndDelete(msg.MustId()); ok {
-		pt, _ := v.(*pendingT)
-
+	reqId, _ := msg.MustId().(string)
+	if pt, ok := self.pendings.Take(reqId); ok {
 		if msg.IsResult() {
+			if err := self.checkResult(pt, msg.MustResult()); err != nil {
+				pt.resultChannel <- err.ToMessage(pt.orig)
+				return nil, nil
+			}
 			resmsg := jsoff.NewResultMessage(pt.orig, msg.MustResult())
 			pt.resultChannel <- resmsg
 		} else {
@@ -169,46 +388,60 @@ func (self *Router) handleResultOrError(msg jsoff.Message) (interface{}, error)
 	return nil, nil
 }
 
-func (self *Router) Feed(msg jsoff.Message) (interface{}, error) {
+// Feed routes a message, the deadline of ctx is the caller's deadline
+func (self *Router) Feed(ctx context.Context, msg jsoff.Message) (interface{}, error) {
+	if (msg.IsRequest() || msg.IsNotify()) && self.Draining() {
+		if reqmsg, ok := msg.(*jsoff.RequestMessage); ok {
+			return ErrDraining.ToMessage(reqmsg), nil
+		}
+		msg.Log().Debugf("node draining, dropped")
+		return nil, nil
+	}
+	if msg.IsRequest() || msg.IsNotify() {
+		m, h := self.resolveSchema(msg)
+		m, c, err := self.resolveVersion(m)
+		if err != nil {
+			if reqmsg, ok := msg.(*jsoff.RequestMessage); ok {
+				return err.ToMessage(reqmsg), nil
+			}
+			return nil, nil
+		}
+		msg = m
+		ctx = withVersionConstraint(ctx, c)
+
+		// conflicting schemas are kept apart in allow mode
+		if h == "" && self.schemaConflictMode(msg.MustMethod()) == SchemaConflictAllow {
+			h = self.primarySchemaHash(msg.MustMethod(), c)
+		}
+		ctx = withSchemaHash(ctx, h)
+
+		sel, err := self.resolveSelector(ctx, msg.MustMethod())
+		if err != nil {
+			if reqmsg, ok := msg.(*jsoff.RequestMessage); ok {
+				return err.ToMessage(reqmsg), nil
+			}
+			return nil, nil
+		}
+		ctx = withSelector(ctx, sel)
+	}
+
 	if msg.IsRequest() {
 		reqmsg, _ := msg.(*jsoff.RequestMessage)
-		return self.handleRequestMessage(reqmsg)
+		return self.handleRequestMessage(ctx, reqmsg)
 	} else if msg.IsNotify() {
 		ntfmsg, _ := msg.(*jsoff.NotifyMessage)
-		return self.handleNotifyMessage(ntfmsg)
+		return self.handleNotifyMessage(ctx, ntfmsg)
 	} else {
 		return self.handleResultOrError(msg)
 	}
 }
 
-func (self *Router) keepalive(rootctx context.Context) {
-	ctx, cancel := context.WithCancel(rootctx)
-	defer cancel()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(time.Second * 30):
-			self.serviceIndex.Range(func(k, v interface{}) bool {
-				service, _ := k.(*Service)
-				go func(srv *Service) {
-					pingmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), "_ping", nil)
-					_, err := self.requestService(srv, pingmsg)
-					if err != nil {
-						pingmsg.Log().Errorf("ping error, %s", err)
-					}
-				}(service)
-				return true
-			})
-		}
-	}
-}
-
 func (self *Router) run(rootctx context.Context) {
 	ctx, cancel := context.WithCancel(self.App().Context())
+	self.ctxLock.Lock()
 	self.ctx = ctx
 	self.cancelFunc = cancel
+	self.ctxLock.Unlock()
 
 	defer self.Stop()
 
@@ -223,12 +456,21 @@ func (self *Router) run(rootctx context.Context) {
 		go self.subscribeStatus(ctx, statusSub)
 	}
 
+	go self.keepalive(ctx)
+
 	// publish the status
 	err := self.publishStatus(ctx)
 	if err != nil {
 		panic(err)
 	}
 
+	// tickers rather than time.After() in the loop, otherwise the
+	// timers restart whenever another case fires
+	publishTicker := time.NewTicker(time.Second * 15)
+	defer publishTicker.Stop()
+	sweepTicker := time.NewTicker(self.App().sweepInterval())
+	defer sweepTicker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -237,12 +479,14 @@ func (self *Router) run(rootctx context.Context) {
 				self.Log().Errorf("publish empty status error, %s", err)
 			}
 			return
-		case <-time.After(time.Second * 15):
+		case <-publishTicker.C:
 			// publish the status of
 			err := self.publishStatus(ctx)
 			if err != nil {
 				panic(err)
 			}
+		case now := <-sweepTicker.C:
+			self.sweepLeases(now)
 		case item, ok := <-statusSub:
 			if !ok {
 				return
@@ -264,24 +508,63 @@ func (self *Router) updateStatus(item mq.MQItem) {
 		self.Log().Errorf("bad decode service status: %s from notify %s", err, jsoff.MessageString(ntf))
 		return
 	}
+	self.applyStatus(st, time.Now())
+}
 
+// applyStatus updates the remote node of a status and renews its lease
+func (self *Router) applyStatus(st serviceStatus, now time.Time) {
 	if st.AdvertiseUrl == self.App().Config.Server.AdvertiseUrl {
 		// self update
 		return
 	}
 
-	if st.Timestamp < (time.Now().Add(-time.Minute * 2)).UTC().Unix() {
+	ttl := self.App().leaseTTL()
+	if !time.Unix(st.Timestamp, 0).Add(ttl).After(now) {
 		// server status expired
 		return
 	}
 	self.Log().Debugf("got service status advurl: %s, ts: %#v, methods: %+v", st.AdvertiseUrl, st.Timestamp, st.Methods)
 
+	if len(st.Methods) == 0 {
+		// the node leaves
+		if v, ok := self.remoteServiceIndex.Load(st.AdvertiseUrl); ok {
+			rsrv, _ := v.(*RemoteService)
+			self.removeRemoteService(rsrv)
+		}
+		return
+	}
+
 	rsrv := self.GetOrCreateRemoteService(st.AdvertiseUrl)
 	removed, added := rsrv.UpdateStatus(st)
+	rsrv.renewLease(ttl)
 	self.UpdateRemoteService(rsrv, removed, added)
 }
 
+// schedulePublish publishes the status after publishDebounce, the
+// changes before that are published together
+func (self *Router) schedulePublish() {
+	self.publishLock.Lock()
+	defer self.publishLock.Unlock()
+	if self.publishTimer != nil {
+		return
+	}
+	self.publishTimer = time.AfterFunc(publishDebounce, func() {
+		self.publishLock.Lock()
+		self.publishTimer = nil
+		self.publishLock.Unlock()
+		if ctx := self.runContext(); ctx != nil {
+			if err := self.publishStatus(ctx); err != nil {
+				self.Log().Errorf("publish status error %s", err)
+			}
+		}
+	})
+}
+
 func (self *Router) publishStatus(ctx context.Context) error {
+	if self.Draining() {
+		// keep peer nodes from forwarding to the draining node
+		return self.publishEmptyStatus(ctx)
+	}
 	if self.mqClient == nil {
 		return nil
 	}
@@ -294,6 +577,11 @@ func (self *Router) publishStatus(ctx context.Context) error {
 	status := serviceStatus{
 		AdvertiseUrl: self.App().Config.Server.AdvertiseUrl,
 		Methods:      methods,
+		Deliveries:   self.Deliveries(),
+		Schemas:      self.SchemaHashes(),
+		Versions:     self.Versions(),
+		Timeouts:     self.Timeouts(),
+		Services:     self.ServiceSummaries(),
 		Timestamp:    time.Now().UTC().Unix(),
 	}
 
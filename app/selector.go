@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/superisaac/jsoff"
+	"strings"
+)
+
+// labelRequirement is a single requirement of a label selector
+type labelRequirement struct {
+	key   string
+	op    string
+	value string
+}
+
+func (self labelRequirement) match(labels map[string]string) bool {
+	v, ok := labels[self.key]
+	switch self.op {
+	case "=":
+		return ok && v == self.value
+	case "!=":
+		return !ok || v != self.value
+	case "exists":
+		return ok
+	case "!exists":
+		return !ok
+	}
+	return false
+}
+
+// LabelSelector selects services by labels, the requirements are
+// joined by commas and all of them must match. Supported forms are
+// key=value, key==value, key!=value, key(the label exists) and
+// !key(the label does not exist).
+type LabelSelector struct {
+	text string
+	reqs []labelRequirement
+}
+
+func (self LabelSelector) String() string {
+	return self.text
+}
+
+func (self LabelSelector) Match(labels map[string]string) bool {
+	for _, r := range self.reqs {
+		if !r.match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func ParseLabelSelector(s string) (*LabelSelector, error) {
+	sel := &LabelSelector{}
+	texts := []string{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		var r labelRequirement
+		if k, v, ok := strings.Cut(f, "!="); ok {
+			r = labelRequirement{strings.TrimSpace(k), "!=", strings.TrimSpace(v)}
+		} else if k, v, ok := strings.Cut(f, "=="); ok {
+			r = labelRequirement{strings.TrimSpace(k), "=", strings.TrimSpace(v)}
+		} else if k, v, ok := strings.Cut(f, "="); ok {
+			r = labelRequirement{strings.TrimSpace(k), "=", strings.TrimSpace(v)}
+		} else if strings.HasPrefix(f, "!") {
+			r = labelRequirement{key: strings.TrimSpace(f[1:]), op: "!exists"}
+		} else {
+			r = labelRequirement{key: f, op: "exists"}
+		}
+		if r.key == "" || strings.ContainsAny(r.key, "=! ") {
+			return nil, errors.Errorf("bad label selector %s", f)
+		}
+		sel.reqs = append(sel.reqs, r)
+		texts = append(texts, f)
+	}
+	if len(sel.reqs) == 0 {
+		return nil, errors.New("empty label selector")
+	}
+	sel.text = strings.Join(texts, ",")
+	return sel, nil
+}
+
+type selectorTextKey struct{}
+
+type selectorKey struct{}
+
+// withSelectorText returns a ctx carrying the label selector asked by
+// the caller, resolved when the message is fed to a router
+func withSelectorText(ctx context.Context, text string) context.Context {
+	return context.WithValue(ctx, selectorTextKey{}, text)
+}
+
+func selectorTextFrom(ctx context.Context) string {
+	if v, ok := ctx.Value(selectorTextKey{}).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// withSelector returns a ctx carrying the label selector of the
+// message being routed, forwarded to remote nodes along with the
+// message
+func withSelector(ctx context.Context, sel *LabelSelector) context.Context {
+	return context.WithValue(ctx, selectorKey{}, sel)
+}
+
+func selectorFrom(ctx context.Context) *LabelSelector {
+	if sel, ok := ctx.Value(selectorKey{}).(*LabelSelector); ok {
+		return sel
+	}
+	return nil
+}
+
+// resolveSelector joins the label selector asked by the caller and
+// the configured one of method
+func (self *Router) resolveSelector(ctx context.Context, method string) (*LabelSelector, *jsoff.RPCError) {
+	texts := []string{}
+	if text := selectorTextFrom(ctx); text != "" {
+		texts = append(texts, text)
+	}
+	if text := lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) string {
+		return m.Selector
+	}); text != "" {
+		texts = append(texts, text)
+	}
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	sel, err := ParseLabelSelector(strings.Join(texts, ","))
+	if err != nil {
+		return nil, jsoff.ParamsError(fmt.Sprintf("%s", err))
+	}
+	return sel, nil
+}
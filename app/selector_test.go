@@ -0,0 +1,93 @@
+package app
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLabelSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	sel, err := ParseLabelSelector("zone=eu, track!=canary,gpu,!legacy")
+	assert.Nil(err)
+	assert.Equal("zone=eu,track!=canary,gpu,!legacy", sel.String())
+
+	assert.True(sel.Match(map[string]string{"zone": "eu", "gpu": "a100"}))
+	assert.True(sel.Match(map[string]string{"zone": "eu", "gpu": "", "track": "stable"}))
+	assert.False(sel.Match(map[string]string{"zone": "us", "gpu": "a100"}))
+	assert.False(sel.Match(map[string]string{"zone": "eu", "gpu": "a100", "track": "canary"}))
+	assert.False(sel.Match(map[string]string{"zone": "eu"}))
+	assert.False(sel.Match(map[string]string{"zone": "eu", "gpu": "a100", "legacy": "1"}))
+
+	sel, err = ParseLabelSelector("zone==eu")
+	assert.Nil(err)
+	assert.True(sel.Match(map[string]string{"zone": "eu"}))
+
+	_, err = ParseLabelSelector(" , ")
+	assert.NotNil(err)
+	_, err = ParseLabelSelector("=eu")
+	assert.NotNil(err)
+}
+
+func TestSelectByLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+
+	router := NewRouter("default")
+	router.app = app
+
+	srv := NewService(router, nil)
+	err := srv.UpdateOptions(declareOptions{
+		Labels:   map[string]string{"track": "stable"},
+		Metadata: serviceMetadata{Zone: "eu", Hostname: "host1", Weight: 3},
+	}, nil)
+	assert.Nil(err)
+	assert.Equal(map[string]string{"track": "stable", "zone": "eu", "hostname": "host1"}, srv.Labels())
+	assert.Equal(3, srv.Weight())
+
+	sel, _ := ParseLabelSelector("zone=eu")
+	crit := &selectCriteria{selector: sel}
+	assert.True(crit.accept("echo", srv))
+
+	rsrv := &RemoteService{Services: []serviceSummary{
+		{Methods: []string{"echo"}, Labels: map[string]string{"zone": "us"}},
+		{Methods: []string{"add"}, Labels: map[string]string{"zone": "eu"}},
+	}}
+	assert.False(crit.accept("echo", rsrv))
+	assert.True(crit.accept("add", rsrv))
+}
+
+func TestConcurrentOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := NewService(nil, nil)
+	sel, _ := ParseLabelSelector("zone=eu")
+	crit := &selectCriteria{selector: sel}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			srv.UpdateOptions(declareOptions{
+				Methods:  map[string]declareMethodOptions{"echo": {Timeout: 1}},
+				Metadata: serviceMetadata{Zone: "eu"},
+			}, nil)
+			srv.AddOptions(declareOptions{
+				Methods: map[string]declareMethodOptions{"add@1.0.0": {Timeout: 2}},
+			}, map[string]string{"add": "add@1.0.0"})
+			srv.RemoveOptions([]string{"add"})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		crit.accept("echo", srv)
+		srv.Timeout("echo")
+		srv.Version("add")
+		srv.Weight()
+	}
+	<-done
+	_, ok := srv.Timeout("echo")
+	assert.True(ok)
+	assert.Equal("eu", srv.Labels()["zone"])
+}
@@ -1,23 +1,49 @@
 package app
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jsoff"
 	"github.com/superisaac/jsoff/net"
 	"github.com/superisaac/jsoff/schema"
-	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 func NewService(router *Router, session jsoffnet.RPCSession) *Service {
 	return &Service{
-		router:  router,
-		session: session,
-		methods: make(map[string]jsoffschema.Schema),
+		router:      router,
+		session:     session,
+		connectedAt: time.Now(),
 	}
 }
 
+// options returns the methods and options declared by the worker, the
+// maps must not be changed
+func (self *Service) options() *serviceOptions {
+	if opts := self.opts.Load(); opts != nil {
+		return opts
+	}
+	return &serviceOptions{}
+}
+
+// updateOptions applies a change to a copy of the options and stores
+// the copy, change must replace the maps instead of changing them
+func (self *Service) updateOptions(change func(opts *serviceOptions) error) error {
+	self.declareLock.Lock()
+	defer self.declareLock.Unlock()
+	opts := *self.options()
+	if err := change(&opts); err != nil {
+		return err
+	}
+	self.opts.Store(&opts)
+	return nil
+}
+
 func (self *Service) UpdateMethods(newMethods map[string]jsoffschema.Schema) error {
-	if self.router == nil {
+	router := self.router
+	if router == nil {
 		log.Errorf("cannot update methods on removed service")
 		return jsoff.ParamsError("update methods failed")
 	}
@@ -28,23 +54,195 @@ func (self *Service) UpdateMethods(newMethods map[string]jsoffschema.Schema) err
 	removed := []string{}
 	added := []string{}
 
-	for mname, _ := range self.methods {
-		if _, ok := newMethods[mname]; !ok {
-			// not present in new methods
-			removed = append(removed, mname)
+	if err := self.updateOptions(func(opts *serviceOptions) error {
+		for mname, _ := range opts.methods {
+			if _, ok := newMethods[mname]; !ok {
+				// not present in new methods
+				removed = append(removed, mname)
+			}
+		}
+
+		for mname, _ := range newMethods {
+			if _, ok := opts.methods[mname]; !ok {
+				// not present in opts.methods
+				added = append(added, mname)
+			}
+		}
+
+		hashes := map[string]string{}
+		for mname, s := range newMethods {
+			hashes[mname] = schemaHash(s)
 		}
+		opts.methods = newMethods
+		opts.hashes = hashes
+		return nil
+	}); err != nil {
+		return err
 	}
+	router.UpdateService(self, removed, added)
+	return nil
+}
 
-	for mname, _ := range newMethods {
-		if _, ok := self.methods[mname]; !ok {
-			// not present in self.methods
-			added = append(added, mname)
+// parseMethodOptions parses the per method options of a declare
+func parseMethodOptions(methods map[string]declareMethodOptions) (map[string]time.Duration, map[string]string, map[string]Version, error) {
+	timeouts := map[string]time.Duration{}
+	deliveries := map[string]string{}
+	versions := map[string]Version{}
+	for name, mopts := range methods {
+		mname, _ := splitVersion(name)
+		if mopts.Timeout > 0 {
+			timeouts[mname] = time.Duration(mopts.Timeout * float64(time.Second))
+		}
+		if !validDelivery(mopts.Delivery) {
+			return nil, nil, nil, jsoff.ParamsError(fmt.Sprintf("bad delivery %s of %s", mopts.Delivery, mname))
+		}
+		if mopts.Delivery != "" {
+			deliveries[mname] = mopts.Delivery
+		}
+		if mopts.Version != "" {
+			v, err := ParseVersion(mopts.Version)
+			if err != nil {
+				return nil, nil, nil, jsoff.ParamsError(fmt.Sprintf("bad version of %s, %s", mname, err))
+			}
+			versions[mname] = v
 		}
 	}
+	return timeouts, deliveries, versions, nil
+}
 
-	self.methods = newMethods
-	self.router.UpdateService(self, removed, added)
-	return nil
+// UpdateOptions replaces the options and versioned names of methods
+// declared by rpcmux.declare
+func (self *Service) UpdateOptions(declared declareOptions, names map[string]string) error {
+	timeouts, deliveries, versions, err := parseMethodOptions(declared.Methods)
+	if err != nil {
+		return err
+	}
+	if declared.Metadata.Weight < 0 {
+		return jsoff.ParamsError("negative weight")
+	}
+	if declared.Metadata.Capacity < 0 {
+		return jsoff.ParamsError("negative capacity")
+	}
+	labels := map[string]string{}
+	for k, v := range declared.Labels {
+		labels[k] = v
+	}
+	for k, v := range map[string]string{
+		"version":  declared.Metadata.Version,
+		"zone":     declared.Metadata.Zone,
+		"hostname": declared.Metadata.Hostname,
+	} {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	return self.updateOptions(func(opts *serviceOptions) error {
+		opts.timeouts = timeouts
+		opts.deliveries = deliveries
+		opts.versions = versions
+		opts.names = names
+		opts.labels = labels
+		opts.metadata = declared.Metadata
+		return nil
+	})
+}
+
+// AddOptions adds the options and versioned names of methods added
+// by declare_add
+func (self *Service) AddOptions(declared declareOptions, names map[string]string) error {
+	timeouts, deliveries, versions, err := parseMethodOptions(declared.Methods)
+	if err != nil {
+		return err
+	}
+	return self.updateOptions(func(opts *serviceOptions) error {
+		for mname, t := range opts.timeouts {
+			if _, ok := declared.Methods[mname]; !ok {
+				timeouts[mname] = t
+			}
+		}
+		for mname, d := range opts.deliveries {
+			if _, ok := declared.Methods[mname]; !ok {
+				deliveries[mname] = d
+			}
+		}
+		for mname, v := range opts.versions {
+			if _, ok := declared.Methods[mname]; !ok {
+				versions[mname] = v
+			}
+		}
+		newNames := map[string]string{}
+		for mname, name := range opts.names {
+			newNames[mname] = name
+		}
+		for mname, name := range names {
+			newNames[mname] = name
+		}
+		opts.timeouts = timeouts
+		opts.deliveries = deliveries
+		opts.versions = versions
+		opts.names = newNames
+		return nil
+	})
+}
+
+// RemoveOptions removes the options and versioned names of methods
+// removed by declare_remove
+func (self *Service) RemoveOptions(mnames []string) {
+	self.updateOptions(func(opts *serviceOptions) error {
+		timeouts := map[string]time.Duration{}
+		for mname, t := range opts.timeouts {
+			if !stringInList(mname, mnames) {
+				timeouts[mname] = t
+			}
+		}
+		deliveries := map[string]string{}
+		for mname, d := range opts.deliveries {
+			if !stringInList(mname, mnames) {
+				deliveries[mname] = d
+			}
+		}
+		versions := map[string]Version{}
+		for mname, v := range opts.versions {
+			if !stringInList(mname, mnames) {
+				versions[mname] = v
+			}
+		}
+		names := map[string]string{}
+		for mname, name := range opts.names {
+			if !stringInList(mname, mnames) {
+				names[mname] = name
+			}
+		}
+		opts.timeouts = timeouts
+		opts.deliveries = deliveries
+		opts.versions = versions
+		opts.names = names
+		return nil
+	})
+}
+
+// Methods returns the schemas of methods declared by the worker, the
+// map must not be changed
+func (self *Service) Methods() map[string]jsoffschema.Schema {
+	return self.options().methods
+}
+
+// Version returns the version of a method declared by the worker
+func (self *Service) Version(method string) (Version, bool) {
+	v, ok := self.options().versions[method]
+	return v, ok
+}
+
+// Timeout returns the timeout of a method declared by the worker
+func (self *Service) Timeout(method string) (time.Duration, bool) {
+	t, ok := self.options().timeouts[method]
+	return t, ok
+}
+
+// Labels returns the labels of the service including the metadata,
+// the map must not be changed
+func (self *Service) Labels() map[string]string {
+	return self.options().labels
 }
 
 func (self *Service) Dismiss() {
@@ -52,19 +250,62 @@ func (self *Service) Dismiss() {
 	self.session = nil
 }
 
+// Send sends a message to the worker, params are validated by the
+// router before dispatch
 func (self *Service) Send(msg jsoff.Message) error {
-	// TODO: schema test
-	self.session.Send(msg)
+	if name, ok := self.options().names[msg.MustMethod()]; ok {
+		// the worker serves the method by a versioned name
+		msg = renameMessage(msg, name)
+	}
+	session := self.session
+	if session == nil {
+		return ErrServiceGone
+	}
+	session.Send(msg)
 	return nil
 }
 
+// RTT returns the round trip time of the last ping
+func (self *Service) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&self.rtt))
+}
+
+func (self *Service) Pending() int64 {
+	return atomic.LoadInt64(&self.pending)
+}
+
+func (self *Service) Weight() int {
+	if w := self.options().metadata.Weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// Capacity returns the requests the worker accepts at once, 0 is
+// unlimited
+func (self *Service) Capacity() int {
+	return self.options().metadata.Capacity
+}
+
+// full tells whether the requests in flight reach the capacity
+func (self *Service) full() bool {
+	c := self.Capacity()
+	return c > 0 && self.Pending() >= int64(c)
+}
+
 func (self *Service) GetSchema(method string) (jsoffschema.Schema, bool) {
-	if s, ok := self.methods[method]; ok && s != nil {
+	if s, ok := self.options().methods[method]; ok && s != nil {
 		return s, true
 	}
 	return nil, false
 }
 
+// SchemaHash returns the hash of the schema of a method, empty if the
+// method has no schema
+func (self *Service) SchemaHash(method string) string {
+	return self.options().hashes[method]
+}
+
 // router methods related to services
 // services methods
 func (self *Router) AddService(method string, service *Service) {
@@ -118,29 +359,145 @@ func (self *Router) UpdateService(service *Service, removed []string, added []st
 		changed = true
 	}
 
-	if changed && self.ctx != nil {
-		go self.publishStatus(self.ctx)
+	// versions and labels may change without methods
+	self.notifyServicesChanged()
+	if changed && self.runContext() != nil {
+		self.schedulePublish()
 	}
 }
 
 func (self *Router) SelectService(method string) (*Service, bool) {
+	return self.selectService(method, nil)
+}
+
+func (self *Router) selectService(method string, crit *selectCriteria) (*Service, bool) {
 	self.serviceLock.RLock()
 	defer self.serviceLock.RUnlock()
 
 	if srvs, ok := self.methodServicesIndex[method]; ok && len(srvs) > 0 {
-		idx := rand.Intn(len(srvs))
-		return srvs[idx], true
+		candidates := make([]*Service, 0, len(srvs))
+		targets := make([]BalanceTarget, 0, len(srvs))
+		shadow := self.shadowConfig(method)
+		for _, srv := range srvs {
+			if shadow != nil && shadow.inGroup(srv) {
+				// shadow services get mirrored requests only
+				continue
+			}
+			if crit.accept(method, srv) {
+				candidates = append(candidates, srv)
+			}
+		}
+		candidates = self.splitCandidates(method, candidates, crit.getHashKey())
+		candidates = spareCandidates(candidates)
+		weights := self.configuredWeights(method)
+		for _, srv := range candidates {
+			targets = append(targets, weightedTarget{srv, weightByLabels(weights, srv.Labels(), srv.Weight())})
+		}
+		if len(candidates) > 0 {
+			idx := self.balancer("local", method).Select(targets)
+			return candidates[idx], true
+		}
 	}
 	return nil, false
 }
 
+// spareCandidates returns the services below their capacities, all
+// services are returned if every one is full so that the workers
+// queue or reject the requests
+func spareCandidates(candidates []*Service) []*Service {
+	spare := make([]*Service, 0, len(candidates))
+	for _, srv := range candidates {
+		if !srv.full() {
+			spare = append(spare, srv)
+		}
+	}
+	if len(spare) == 0 {
+		return candidates
+	}
+	return spare
+}
+
+// ServicesInfo returns the local services serving the namespace
+func (self *Router) ServicesInfo() []map[string]interface{} {
+	infoList := []map[string]interface{}{}
+	self.serviceIndex.Range(func(k, v interface{}) bool {
+		service, _ := v.(*Service)
+		methods := []string{}
+		for mname, _ := range service.Methods() {
+			methods = append(methods, mname)
+		}
+		sort.Strings(methods)
+		infoList = append(infoList, map[string]interface{}{
+			"session_id":   k,
+			"remote_addr":  service.remoteAddr,
+			"methods":      methods,
+			"pending":      service.Pending(),
+			"connected_at": service.connectedAt.UTC().Unix(),
+			"labels":       service.Labels(),
+			"weight":       service.Weight(),
+			"capacity":     service.Capacity(),
+			"rtt":          service.RTT().Seconds(),
+			"missed_pings": atomic.LoadInt32(&service.missedPings),
+		})
+		return true
+	})
+	return infoList
+}
+
+// ServiceSummaries returns the local services published within the
+// status of the node
+func (self *Router) ServiceSummaries() []serviceSummary {
+	summaries := []serviceSummary{}
+	self.serviceIndex.Range(func(k, v interface{}) bool {
+		service, _ := v.(*Service)
+		if len(service.Methods()) == 0 {
+			return true
+		}
+		methods := []string{}
+		for mname, _ := range service.Methods() {
+			methods = append(methods, mname)
+		}
+		sort.Strings(methods)
+		summaries = append(summaries, serviceSummary{
+			Methods: methods,
+			Labels:  service.Labels(),
+			Weight:  service.Weight(),
+		})
+		return true
+	})
+	return summaries
+}
+
+// Timeouts returns the longest timeouts in seconds declared by local
+// services, a peer node forwarding a request waits as long
+func (self *Router) Timeouts() map[string]float64 {
+	timeouts := map[string]float64{}
+	self.serviceIndex.Range(func(k, v interface{}) bool {
+		service, _ := v.(*Service)
+		for mname, t := range service.options().timeouts {
+			if t.Seconds() > timeouts[mname] {
+				timeouts[mname] = t.Seconds()
+			}
+		}
+		return true
+	})
+	return timeouts
+}
+
 func (self *Router) ServingMethods() []string {
 	self.serviceLock.RLock()
 	defer self.serviceLock.RUnlock()
 
 	methods := []string{}
-	for mname, _ := range self.methodServicesIndex {
-		methods = append(methods, mname)
+	for mname, srvs := range self.methodServicesIndex {
+		// methods served only by draining services are not
+		// published
+		for _, srv := range srvs {
+			if !srv.Draining() {
+				methods = append(methods, mname)
+				break
+			}
+		}
 	}
 	return methods
 }
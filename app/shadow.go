@@ -0,0 +1,154 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/superisaac/jsoff"
+	"math/rand"
+)
+
+const (
+	defaultShadowGroup = "shadow"
+)
+
+// ShadowConfig mirrors a fraction of the requests of a method to a
+// shadow service group, shadow results are compared with the primary
+// results and then discarded
+type ShadowConfig struct {
+	// the fraction of requests mirrored, from 0 to 1
+	Fraction float64 `yaml:"fraction"`
+
+	// the label grouping services, track by default
+	Label string `yaml:"label,omitempty"`
+
+	// the label value of shadow services, shadow by default
+	Group string `yaml:"group,omitempty"`
+
+	// the MQ section mismatches are published to, mismatches are
+	// only logged if empty
+	Section string `yaml:"section,omitempty"`
+}
+
+func (self ShadowConfig) label() string {
+	if self.Label != "" {
+		return self.Label
+	}
+	return defaultSplitLabel
+}
+
+func (self ShadowConfig) group() string {
+	if self.Group != "" {
+		return self.Group
+	}
+	return defaultShadowGroup
+}
+
+// inGroup tells whether a service belongs to the shadow group
+func (self ShadowConfig) inGroup(srv *Service) bool {
+	return srv.Labels()[self.label()] == self.group()
+}
+
+func (self *Router) shadowConfig(method string) *ShadowConfig {
+	return lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) *ShadowConfig {
+		return m.Shadow
+	})
+}
+
+// selectShadowService selects a service from the shadow group of
+// method
+func (self *Router) selectShadowService(method string, shadow *ShadowConfig, crit *selectCriteria) (*Service, bool) {
+	self.serviceLock.RLock()
+	defer self.serviceLock.RUnlock()
+
+	candidates := []*Service{}
+	targets := []BalanceTarget{}
+	for _, srv := range self.methodServicesIndex[method] {
+		if shadow.inGroup(srv) && crit.accept(method, srv) {
+			candidates = append(candidates, srv)
+			targets = append(targets, srv)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	idx := self.balancer("shadow", method).Select(targets)
+	return candidates[idx], true
+}
+
+// startShadow mirrors a request to a shadow service if the request
+// falls in the fraction, the primary result should be sent to the
+// returned channel which never blocks. The shadow request runs aside
+// and adds no latency to the primary request.
+func (self *Router) startShadow(ctx context.Context, reqmsg *jsoff.RequestMessage, crit *selectCriteria) chan interface{} {
+	shadow := self.shadowConfig(reqmsg.Method)
+	if shadow == nil || rand.Float64() >= shadow.Fraction {
+		return nil
+	}
+	service, ok := self.selectShadowService(reqmsg.Method, shadow, crit)
+	if !ok {
+		return nil
+	}
+	primaryChannel := make(chan interface{}, 1)
+	// the shadow request outlives the caller
+	shadowCtx := context.WithoutCancel(ctx)
+	go func() {
+		self.metrics.Incr(MetricShadowRequests, reqmsg.Method)
+		shadowRes, err := self.requestService(shadowCtx, service, reqmsg)
+		if err != nil {
+			reqmsg.Log().Warnf("shadow request error, %s", err)
+			return
+		}
+		primaryRes := <-primaryChannel
+		primarymsg, ok := primaryRes.(jsoff.Message)
+		if !ok {
+			// the primary request failed without a message
+			return
+		}
+		shadowmsg, _ := shadowRes.(jsoff.Message)
+		if !sameResponse(primarymsg, shadowmsg) {
+			self.reportShadowMismatch(shadowCtx, shadow, reqmsg, primarymsg, shadowmsg)
+		}
+	}()
+	return primaryChannel
+}
+
+// sameResponse compares the results or the error codes of two
+// responses
+func sameResponse(a jsoff.Message, b jsoff.Message) bool {
+	if a.IsResult() && b.IsResult() {
+		abytes, err := json.Marshal(a.MustResult())
+		if err != nil {
+			return false
+		}
+		bbytes, err := json.Marshal(b.MustResult())
+		if err != nil {
+			return false
+		}
+		return bytes.Equal(abytes, bbytes)
+	} else if a.IsError() && b.IsError() {
+		return a.MustError().Code == b.MustError().Code
+	}
+	return false
+}
+
+func (self *Router) reportShadowMismatch(ctx context.Context, shadow *ShadowConfig, reqmsg *jsoff.RequestMessage, primarymsg jsoff.Message, shadowmsg jsoff.Message) {
+	self.metrics.Incr(MetricShadowMismatches, reqmsg.Method)
+	reqmsg.Log().Warnf("shadow response mismatches the primary one")
+	if shadow.Section == "" || self.mqClient == nil {
+		return
+	}
+	primaryMap, _ := jsoff.MessageMap(primarymsg)
+	shadowMap, _ := jsoff.MessageMap(shadowmsg)
+	ntf := jsoff.NewNotifyMessage("rpcmux.shadow_mismatch", map[string]interface{}{
+		"namespace": self.namespace,
+		"method":    reqmsg.Method,
+		"params":    reqmsg.Params,
+		"primary":   primaryMap,
+		"shadow":    shadowMap,
+	})
+	ntf.SetTraceId(reqmsg.TraceId())
+	if _, err := self.mqClient.Add(ctx, shadow.Section, ntf); err != nil {
+		reqmsg.Log().Errorf("publish shadow mismatch error, %s", err)
+	}
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+)
+
+const (
+	defaultSplitLabel = "track"
+
+	// the group of services without the split label
+	splitDefaultGroup = "default"
+)
+
+// SplitConfig splits the traffic of a method between service groups,
+// services are grouped by the value of a label, such as track: canary
+type SplitConfig struct {
+	// the label grouping services, track by default
+	Label string `yaml:"label,omitempty" json:"label,omitempty"`
+
+	// relative weights of groups, such as canary: 5, stable: 95,
+	// groups not listed get no traffic unless no listed group has
+	// services
+	Weights map[string]int `yaml:"weights" json:"weights"`
+}
+
+func (self SplitConfig) label() string {
+	if self.Label != "" {
+		return self.Label
+	}
+	return defaultSplitLabel
+}
+
+// chooseGroup chooses one of the groups present by weights, the
+// choice is sticky to hashKey if it's not empty
+func (self SplitConfig) chooseGroup(present map[string]bool, method string, hashKey string) (string, bool) {
+	groups := []string{}
+	total := 0
+	for g, _ := range present {
+		if w := self.Weights[g]; w > 0 {
+			groups = append(groups, g)
+			total += w
+		}
+	}
+	if total <= 0 {
+		return "", false
+	}
+	// sort the groups to make the sticky choice stable
+	sort.Strings(groups)
+
+	var r int
+	if hashKey != "" {
+		h := fnv.New32a()
+		h.Write([]byte(method + ":" + hashKey))
+		r = int(h.Sum32() % uint32(total))
+	} else {
+		r = rand.Intn(total)
+	}
+	for _, g := range groups {
+		w := self.Weights[g]
+		if r < w {
+			return g, true
+		}
+		r -= w
+	}
+	return groups[len(groups)-1], true
+}
+
+// splitConfig returns the split of a method, the one set by admin RPC
+// precedes the configured one
+func (self *Router) splitConfig(method string) *SplitConfig {
+	if v, ok := self.splits.Load(method); ok {
+		split, _ := v.(*SplitConfig)
+		return split
+	}
+	return lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) *SplitConfig {
+		return m.Split
+	})
+}
+
+// SetSplit overrides the split of a method, nil removes the override
+func (self *Router) SetSplit(method string, split *SplitConfig) {
+	if split == nil {
+		self.splits.Delete(method)
+	} else {
+		self.splits.Store(method, split)
+	}
+}
+
+// Splits returns the splits overridden by admin RPC
+func (self *Router) Splits() map[string]*SplitConfig {
+	splits := map[string]*SplitConfig{}
+	self.splits.Range(func(k, v interface{}) bool {
+		method, _ := k.(string)
+		split, _ := v.(*SplitConfig)
+		splits[method] = split
+		return true
+	})
+	return splits
+}
+
+// splitCandidates narrows the candidates to the group chosen by the
+// split of method
+func (self *Router) splitCandidates(method string, candidates []*Service, hashKey string) []*Service {
+	split := self.splitConfig(method)
+	if split == nil || len(candidates) <= 1 {
+		return candidates
+	}
+	label := split.label()
+	groupOf := func(srv *Service) string {
+		if g, ok := srv.Labels()[label]; ok && g != "" {
+			return g
+		}
+		return splitDefaultGroup
+	}
+
+	present := map[string]bool{}
+	for _, srv := range candidates {
+		present[groupOf(srv)] = true
+	}
+	group, ok := split.chooseGroup(present, method, hashKey)
+	if !ok {
+		return candidates
+	}
+	chosen := []*Service{}
+	for _, srv := range candidates {
+		if groupOf(srv) == group {
+			chosen = append(chosen, srv)
+		}
+	}
+	return chosen
+}
+
+type hashKeyKey struct{}
+
+// withHashKey returns a ctx carrying the caller's hash key, which
+// makes the split decisions sticky
+func withHashKey(ctx context.Context, hashKey string) context.Context {
+	return context.WithValue(ctx, hashKeyKey{}, hashKey)
+}
+
+func hashKeyFrom(ctx context.Context) string {
+	if v, ok := ctx.Value(hashKeyKey{}).(string); ok {
+		return v
+	}
+	return ""
+}
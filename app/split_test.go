@@ -0,0 +1,55 @@
+package app
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSplitCandidates(t *testing.T) {
+	assert := assert.New(t)
+
+	app := NewApp()
+	defer app.Stop()
+	app.Config.Router.Methods = map[string]*MethodConfig{
+		"echo": {Split: &SplitConfig{Weights: map[string]int{"canary": 1, "stable": 3}}},
+	}
+
+	router := NewRouter("default")
+	router.app = app
+
+	stable := &Service{}
+	assert.Nil(stable.UpdateOptions(declareOptions{Labels: map[string]string{"track": "stable"}}, nil))
+	canary := &Service{}
+	assert.Nil(canary.UpdateOptions(declareOptions{Labels: map[string]string{"track": "canary"}}, nil))
+	other := &Service{}
+	candidates := []*Service{stable, canary, other}
+
+	counts := map[*Service]int{}
+	for i := 0; i < 4000; i++ {
+		chosen := router.splitCandidates("echo", candidates, "")
+		assert.Equal(1, len(chosen))
+		counts[chosen[0]]++
+	}
+	assert.Equal(0, counts[other])
+	assert.InDelta(1000, counts[canary], 200)
+	assert.InDelta(3000, counts[stable], 200)
+
+	// sticky by the hash key
+	first := router.splitCandidates("echo", candidates, "user1")
+	for i := 0; i < 20; i++ {
+		assert.Equal(first, router.splitCandidates("echo", candidates, "user1"))
+	}
+
+	// no weighted group is present
+	assert.Equal([]*Service{other}, router.splitCandidates("echo", []*Service{other}, ""))
+	assert.Equal(candidates, router.splitCandidates("add", candidates, ""))
+
+	// override by admin
+	router.SetSplit("echo", &SplitConfig{Weights: map[string]int{"default": 1}})
+	assert.Equal([]*Service{other}, router.splitCandidates("echo", candidates, ""))
+	router.SetSplit("echo", nil)
+	assert.Equal(0, len(router.Splits()))
+
+	assert.NotNil((&SplitConfig{Weights: map[string]int{"canary": -1, "stable": 2}}).validateValues())
+	assert.NotNil((&SplitConfig{Weights: map[string]int{"canary": 0}}).validateValues())
+}
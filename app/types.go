@@ -8,6 +8,7 @@ import (
 	"github.com/superisaac/rpcmux/mq"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,15 +17,144 @@ type MQConfig struct {
 	url    *url.URL `yaml:"-"`
 }
 
+// MethodConfig holds the routing settings of a method, the same
+// fields inlined in RouterConfig act as the defaults of all methods
+type MethodConfig struct {
+	Balance string        `yaml:"balance,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// relative weights of services by label selector, overriding the
+	// weights declared by workers, the first matching selector wins
+	Weights []WeightConfig `yaml:"weights,omitempty"`
+
+	// only idempotent methods are retried, a method sets false to
+	// opt out of the namespace default
+	Idempotent *bool        `yaml:"idempotent,omitempty"`
+	Retry      *RetryConfig `yaml:"retry,omitempty"`
+
+	// check results against the returns schemas, off, log or enforce
+	ValidateReturns string `yaml:"validate_returns,omitempty"`
+
+	// what to do when services declare different schemas of a
+	// method, warn, reject or allow
+	SchemaConflict string `yaml:"schema_conflict,omitempty"`
+
+	// version constraint of the calls not asking for a version
+	Version string `yaml:"version,omitempty"`
+
+	// traffic split between service groups
+	Split *SplitConfig `yaml:"split,omitempty"`
+
+	// mirror requests to a shadow service group
+	Shadow *ShadowConfig `yaml:"shadow,omitempty"`
+
+	// label selector of services, such as zone=eu, joined with the
+	// selector asked by the caller
+	Selector string `yaml:"selector,omitempty"`
+
+	// how long a request waits for a service to declare the method,
+	// such as during rolling deploys
+	WaitForService time.Duration `yaml:"wait_for_service,omitempty"`
+}
+
+// WeightConfig weights the services matching a label selector, such
+// as hostname=host1
+type WeightConfig struct {
+	Selector string `yaml:"selector"`
+	Weight   int    `yaml:"weight"`
+}
+
+// RetryConfig is the policy to retry a failed request on another
+// service
+type RetryConfig struct {
+	// max attempts including the first one
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// error codes to retry besides the service gone error and the
+	// transport errors of remote services
+	Codes []int `yaml:"codes,omitempty"`
+
+	// backoff before the 2nd attempt, doubled for each further attempt
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+}
+
+// RouterConfig holds the routing settings of the whole server or of
+// a namespace
+type RouterConfig struct {
+	MethodConfig `yaml:",inline"`
+	Methods      map[string]*MethodConfig `yaml:"methods,omitempty"`
+
+	// check the params of requests and notifies against the schemas
+	// declared by workers, on by default
+	ValidateParams *bool `yaml:"validate_params,omitempty"`
+
+	Keepalive KeepaliveConfig `yaml:"keepalive,omitempty"`
+}
+
+// KeepaliveConfig configures the pings of local services, services
+// missing max_missed pings in a row are dismissed
+type KeepaliveConfig struct {
+	Interval  time.Duration `yaml:"interval,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	MaxMissed int           `yaml:"max_missed,omitempty"`
+}
+
+// BreakerConfig configures the circuit breakers of remote nodes
+type BreakerConfig struct {
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// failure rate within a window to open the breaker, 0~1
+	ErrorRate float64 `yaml:"error_rate,omitempty"`
+
+	// minimal calls within a window before the breaker can open
+	MinCalls int `yaml:"min_calls,omitempty"`
+
+	Window time.Duration `yaml:"window,omitempty"`
+
+	// calls slower than slow_call count as failures, 0 disables it
+	SlowCall time.Duration `yaml:"slow_call,omitempty"`
+
+	// how long an open breaker waits before turning half open
+	OpenTimeout time.Duration `yaml:"open_timeout,omitempty"`
+
+	// probe calls allowed when half open
+	HalfOpenCalls int `yaml:"half_open_calls,omitempty"`
+}
+
+// ClusterConfig holds the settings between rpcmux nodes
+type ClusterConfig struct {
+	// shared secret nodes authenticate each other with when
+	// forwarding messages
+	Secret string `yaml:"secret,omitempty"`
+
+	// max times a message can be forwarded between nodes
+	MaxHops int `yaml:"max_hops,omitempty"`
+
+	// a remote node is removed when no status renews its lease
+	// within lease_ttl, the leases are swept every sweep_interval
+	LeaseTTL      time.Duration `yaml:"lease_ttl,omitempty"`
+	SweepInterval time.Duration `yaml:"sweep_interval,omitempty"`
+
+	Breaker BreakerConfig `yaml:"breaker,omitempty"`
+}
+
 type AppConfig struct {
 	Server struct {
 		Bind         string               `yaml:"bind"`
 		AdvertiseUrl string               `yaml:"advertise_url,omitempty"`
 		Auth         *jsoffnet.AuthConfig `yaml:"auth,omitempty"`
 		TLS          *jsoffnet.TLSConfig  `yaml:"tls,omitempty"`
+
+		// how long to wait for pending requests on shutdown
+		DrainTimeout time.Duration `yaml:"drain_timeout,omitempty"`
 	} `yaml:"server"`
 
 	MQ MQConfig `yaml:"mq,omitempty"`
+
+	Cluster ClusterConfig `yaml:"cluster,omitempty"`
+
+	Router     RouterConfig             `yaml:"router,omitempty"`
+	Namespaces map[string]*RouterConfig `yaml:"namespaces,omitempty"`
 }
 
 type App struct {
@@ -32,28 +162,108 @@ type App struct {
 	Config     *AppConfig
 	ctx        context.Context
 	cancelFunc func()
+
+	// links to peer nodes shared by routers
+	linkLock sync.Mutex
+	links    map[string]*linkRef
+
+	// session id and request id => cancel func of the requests
+	// forwarded from peer nodes
+	forwards sync.Map
+}
+
+// options of a declared method, sent within the optional 2nd param
+// of rpcmux.declare
+type declareMethodOptions struct {
+	// timeout in seconds
+	Timeout float64 `json:"timeout,omitempty"`
+
+	// delivery mode of a notify method, broadcast or any
+	Delivery string `json:"delivery,omitempty"`
+
+	// semantic version such as 1.2.0
+	Version string `json:"version,omitempty"`
+}
+
+type declareOptions struct {
+	Methods map[string]declareMethodOptions `json:"methods,omitempty"`
+
+	// labels of the service, such as track: canary
+	Labels map[string]string `json:"labels,omitempty"`
+
+	Metadata serviceMetadata `json:"metadata,omitempty"`
+}
+
+// metadata of a service declared by the worker, version, zone and
+// hostname are also labels of the service
+type serviceMetadata struct {
+	// the version of the worker itself
+	Version  string `json:"version,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+
+	// relative weight used by weighted balancers, 1 by default
+	Weight int `json:"weight,omitempty"`
+
+	// requests the worker accepts at once, 0 is unlimited
+	Capacity int `json:"capacity,omitempty"`
+}
+
+// serviceSummary is a local service within the status of a node
+type serviceSummary struct {
+	Methods []string          `json:"methods"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Weight  int               `json:"weight,omitempty"`
 }
 
 // router related
 type pendingT struct {
+	reqId         string
 	orig          *jsoff.RequestMessage
 	resultChannel chan jsoff.Message
 	toService     *Service
 	expiration    time.Time
+	timeout       time.Duration
+	limit         string
+
+	// index in the expiration heap
+	index int
 }
 
 type serviceStatus struct {
-	AdvertiseUrl string   `json:"advertise_url"`
-	Methods      []string `json:"methods"`
-	Timestamp    int64    `json:"timestamp"`
+	AdvertiseUrl string              `json:"advertise_url"`
+	Methods      []string            `json:"methods"`
+	Deliveries   map[string]string   `json:"deliveries,omitempty"`
+	Schemas      map[string][]string `json:"schemas,omitempty"`
+	Versions     map[string][]string `json:"versions,omitempty"`
+	Timeouts     map[string]float64  `json:"timeouts,omitempty"`
+	Services     []serviceSummary    `json:"services,omitempty"`
+	Timestamp    int64               `json:"timestamp"`
 }
 
 type RemoteService struct {
 	AdvertiseUrl string
 	Methods      map[string]bool
+	Deliveries   map[string]string
+	Schemas      map[string][]string
+	Versions     map[string][]string
+	Services     []serviceSummary
 	UpdateAt     time.Time
 
-	client jsoffnet.Client
+	// the longest timeouts in seconds declared by the services of
+	// the node
+	Timeouts map[string]float64
+
+	// renewed by each status of the node
+	leaseExpiry time.Time
+
+	app      *App
+	linkLock sync.Mutex
+	link     *nodeLink
+	breaker  *circuitBreaker
+
+	// number of requests in flight
+	pending int64
 }
 
 type Router struct {
@@ -62,7 +272,8 @@ type Router struct {
 
 	app *App
 
-	// context
+	// context, set while the router runs
+	ctxLock    sync.Mutex
 	ctx        context.Context
 	cancelFunc func()
 
@@ -80,7 +291,26 @@ type Router struct {
 	methodRemoteServices map[string][]*RemoteService
 
 	// pending requests
-	pendings sync.Map
+	pendings *pendingTable
+
+	// balancers of methods
+	balancers sync.Map
+
+	metrics *routerMetrics
+
+	// traffic splits set by admin RPC
+	splits sync.Map
+
+	// set when the node shuts down
+	draining int32
+
+	// closed and renewed on each change of services
+	changeLock    sync.Mutex
+	changeChannel chan struct{}
+
+	// debounced status publish
+	publishLock  sync.Mutex
+	publishTimer *time.Timer
 
 	// mq
 	mqClient mq.MQClient
@@ -89,5 +319,44 @@ type Router struct {
 type Service struct {
 	router  *Router
 	session jsoffnet.RPCSession
+
+	remoteAddr  string
+	connectedAt time.Time
+
+	// serializes the declarations, routing reads the options
+	// without lock so a declaration replaces them as a whole
+	declareLock sync.Mutex
+	opts        atomic.Pointer[serviceOptions]
+
+	// round trip time of the last ping in nanoseconds and the pings
+	// missed in a row
+	rtt         int64
+	missedPings int32
+
+	// set by rpcmux.drain
+	draining int32
+
+	// number of requests in flight
+	pending int64
+}
+
+// serviceOptions are the methods and options declared by a worker,
+// never changed once stored
+type serviceOptions struct {
 	methods map[string]jsoffschema.Schema
+
+	// method => schema hash, empty for methods without schema
+	hashes map[string]string
+
+	// timeouts, delivery modes and versions declared by the worker
+	timeouts   map[string]time.Duration
+	deliveries map[string]string
+	versions   map[string]Version
+
+	// method => the name declared by the worker, such as add@1.2.0
+	names map[string]string
+
+	// labels including the metadata
+	labels   map[string]string
+	metadata serviceMetadata
 }
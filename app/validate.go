@@ -0,0 +1,104 @@
+package app
+
+import (
+	"fmt"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/schema"
+)
+
+// modes to validate results against returns schemas
+const (
+	ReturnsOff     = "off"
+	ReturnsLog     = "log"
+	ReturnsEnforce = "enforce"
+)
+
+// paramsValidated tells whether the params of messages are validated
+// in the namespace
+func (self *Router) paramsValidated() bool {
+	for _, cfg := range self.App().Config.routerConfigs(self.namespace) {
+		if cfg.ValidateParams != nil {
+			return *cfg.ValidateParams
+		}
+	}
+	return true
+}
+
+// methodSchema returns the method schema declared by a local service
+// matching crit
+func (self *Router) methodSchema(method string, crit *selectCriteria) (*jsoffschema.MethodSchema, bool) {
+	self.serviceLock.RLock()
+	defer self.serviceLock.RUnlock()
+
+	for _, srv := range self.methodServicesIndex[method] {
+		if !crit.accept(method, srv) {
+			continue
+		}
+		if s, ok := srv.GetSchema(method); ok {
+			if ms, ok := s.(*jsoffschema.MethodSchema); ok {
+				return ms, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// checkParams validates the params of a request or notify, the error
+// data carries the path of the invalid param. Methods served by remote
+// nodes only are checked by the nodes.
+func (self *Router) checkParams(msg jsoff.Message, crit *selectCriteria) *jsoff.RPCError {
+	if !self.paramsValidated() {
+		return nil
+	}
+	ms, ok := self.methodSchema(msg.MustMethod(), crit)
+	if !ok {
+		return nil
+	}
+	validator := jsoffschema.NewSchemaValidator()
+	if errPos := ms.ScanParams(validator, msg.MustParams()); errPos != nil {
+		err := jsoff.ParamsError(errPos.Error())
+		err.Data = map[string]interface{}{
+			"path": errPos.Path(),
+		}
+		return err
+	}
+	return nil
+}
+
+// checkResult validates the result of a request against the returns
+// schema declared by the service that answers. Violations are counted
+// in metrics, in enforce mode the caller gets a server error instead.
+func (self *Router) checkResult(pt *pendingT, result interface{}) *jsoff.RPCError {
+	method := pt.orig.Method
+	mode := lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) string {
+		return m.ValidateReturns
+	})
+	if mode == "" || mode == ReturnsOff || pt.toService == nil {
+		return nil
+	}
+	s, ok := pt.toService.GetSchema(method)
+	if !ok {
+		return nil
+	}
+	ms, ok := s.(*jsoffschema.MethodSchema)
+	if !ok {
+		return nil
+	}
+	validator := jsoffschema.NewSchemaValidator()
+	errPos := ms.ScanResult(validator, result)
+	if errPos == nil {
+		return nil
+	}
+	self.metrics.Incr(MetricReturnsViolations, method)
+	pt.orig.Log().Warnf("result violates the returns schema, %s", errPos)
+	if mode != ReturnsEnforce {
+		return nil
+	}
+	return &jsoff.RPCError{
+		Code:    jsoff.ErrServerError.Code,
+		Message: fmt.Sprintf("bad result from service, %s", errPos),
+		Data: map[string]interface{}{
+			"path": errPos.Path(),
+		},
+	}
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/superisaac/jsoff"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version of a method, such as 1.2.3
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+
+	// the prerelease part, such as beta.1
+	Pre string
+}
+
+func (self Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", self.Major, self.Minor, self.Patch)
+	if self.Pre != "" {
+		s += "-" + self.Pre
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1, prerelease versions are lower than the
+// release
+func (self Version) Compare(other Version) int {
+	for _, d := range []int{self.Major - other.Major, self.Minor - other.Minor, self.Patch - other.Patch} {
+		if d < 0 {
+			return -1
+		} else if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case self.Pre == other.Pre:
+		return 0
+	case self.Pre == "":
+		return 1
+	case other.Pre == "":
+		return -1
+	case self.Pre < other.Pre:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// parseVersionParts parses a full or partial version, returns how
+// many of major, minor and patch are given
+func parseVersionParts(s string) (Version, int, error) {
+	var v Version
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if s == "" {
+		return v, 0, errors.New("empty version")
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.Pre = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, errors.Errorf("bad version %s", s)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, 0, errors.Errorf("bad version %s", s)
+		}
+		*nums[i] = n
+	}
+	if v.Pre != "" && len(parts) < 3 {
+		return v, 0, errors.Errorf("bad version %s", s)
+	}
+	return v, len(parts), nil
+}
+
+// ParseVersion parses a version, the missing minor or patch is 0
+func ParseVersion(s string) (Version, error) {
+	v, _, err := parseVersionParts(s)
+	return v, err
+}
+
+// versionRange is a single comparison of a constraint
+type versionRange struct {
+	op string
+	v  Version
+}
+
+func (self versionRange) match(v Version) bool {
+	c := v.Compare(self.v)
+	switch self.op {
+	case "=":
+		return c == 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	}
+	return false
+}
+
+// VersionConstraint matches versions, the ranges are joined by
+// commas or spaces and all of them must match. Supported forms are
+// =, >, >=, <, <=, ^1.2 (same major), ~1.2 (same minor), a partial
+// version such as 1 or 1.2 matching the versions it prefixes, and *.
+type VersionConstraint struct {
+	text   string
+	ranges []versionRange
+}
+
+func (self VersionConstraint) String() string {
+	return self.text
+}
+
+func (self VersionConstraint) Match(v Version) bool {
+	for _, r := range self.ranges {
+		if !r.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func ParseVersionConstraint(s string) (*VersionConstraint, error) {
+	c := &VersionConstraint{text: strings.TrimSpace(s)}
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	if len(fields) == 0 {
+		return nil, errors.New("empty version constraint")
+	}
+	for _, f := range fields {
+		if f == "*" || f == "x" {
+			continue
+		}
+		op := ""
+		for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+			if strings.HasPrefix(f, prefix) {
+				op = prefix
+				f = f[len(prefix):]
+				break
+			}
+		}
+		f = strings.TrimSuffix(strings.TrimSuffix(f, ".x"), ".*")
+		v, nparts, err := parseVersionParts(f)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "^":
+			upper := Version{Major: v.Major + 1}
+			if v.Major == 0 && nparts > 1 {
+				upper = Version{Minor: v.Minor + 1}
+			}
+			c.ranges = append(c.ranges, versionRange{">=", v}, versionRange{"<", upper})
+		case "~":
+			upper := Version{Major: v.Major, Minor: v.Minor + 1}
+			if nparts == 1 {
+				upper = Version{Major: v.Major + 1}
+			}
+			c.ranges = append(c.ranges, versionRange{">=", v}, versionRange{"<", upper})
+		case "":
+			if nparts == 3 {
+				c.ranges = append(c.ranges, versionRange{"=", v})
+			} else if nparts == 2 {
+				c.ranges = append(c.ranges, versionRange{">=", v}, versionRange{"<", Version{Major: v.Major, Minor: v.Minor + 1}})
+			} else {
+				c.ranges = append(c.ranges, versionRange{">=", v}, versionRange{"<", Version{Major: v.Major + 1}})
+			}
+		default:
+			c.ranges = append(c.ranges, versionRange{op, v})
+		}
+	}
+	return c, nil
+}
+
+// splitVersion splits a method name such as add@1.2 to the method
+// and the version part
+func splitVersion(name string) (string, string) {
+	if i := strings.LastIndex(name, "@"); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+type versionKey struct{}
+
+// withVersionConstraint returns a ctx carrying the version constraint
+// of the message being routed, forwarded to remote nodes along with
+// the message
+func withVersionConstraint(ctx context.Context, c *VersionConstraint) context.Context {
+	return context.WithValue(ctx, versionKey{}, c)
+}
+
+func versionConstraintFrom(ctx context.Context) *VersionConstraint {
+	if c, ok := ctx.Value(versionKey{}).(*VersionConstraint); ok {
+		return c
+	}
+	return nil
+}
+
+// renameMessage returns a copy of a request or notify with another
+// method name
+func renameMessage(msg jsoff.Message, method string) jsoff.Message {
+	if reqmsg, ok := msg.(*jsoff.RequestMessage); ok {
+		newmsg := jsoff.NewRequestMessage(reqmsg.Id, method, reqmsg.Params)
+		newmsg.SetTraceId(reqmsg.TraceId())
+		return newmsg
+	} else if ntfmsg, ok := msg.(*jsoff.NotifyMessage); ok {
+		newmsg := jsoff.NewNotifyMessage(method, ntfmsg.Params)
+		newmsg.SetTraceId(ntfmsg.TraceId())
+		return newmsg
+	}
+	return msg
+}
+
+// resolveVersion strips the version constraint from the method of a
+// request or notify, calls without a constraint get the configured
+// default one
+func (self *Router) resolveVersion(msg jsoff.Message) (jsoff.Message, *VersionConstraint, *jsoff.RPCError) {
+	method, vstr := splitVersion(msg.MustMethod())
+	if vstr != "" {
+		msg = renameMessage(msg, method)
+	} else {
+		vstr = lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) string {
+			return m.Version
+		})
+		if vstr == "" {
+			return msg, nil, nil
+		}
+	}
+	c, err := ParseVersionConstraint(vstr)
+	if err != nil {
+		return msg, nil, jsoff.ParamsError(fmt.Sprintf("bad version constraint %s", vstr))
+	}
+	return msg, c, nil
+}
+
+// Versions returns the versions of methods declared by local services
+func (self *Router) Versions() map[string][]string {
+	versions := map[string][]string{}
+	self.serviceIndex.Range(func(k, v interface{}) bool {
+		service, _ := v.(*Service)
+		for mname, ver := range service.options().versions {
+			if vstr := ver.String(); !stringInList(vstr, versions[mname]) {
+				versions[mname] = append(versions[mname], vstr)
+			}
+		}
+		return true
+	})
+	return versions
+}
+
+// AllVersions returns the versions of methods declared by local
+// services and remote nodes
+func (self *Router) AllVersions() map[string][]string {
+	versions := self.Versions()
+	self.remoteServiceIndex.Range(func(k, v interface{}) bool {
+		rsrv, _ := v.(*RemoteService)
+		for mname, vstrs := range rsrv.Versions {
+			for _, vstr := range vstrs {
+				if !stringInList(vstr, versions[mname]) {
+					versions[mname] = append(versions[mname], vstr)
+				}
+			}
+		}
+		return true
+	})
+	for _, vstrs := range versions {
+		sort.Strings(vstrs)
+	}
+	return versions
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	v, err := ParseVersion("v1.2.3")
+	assert.Nil(err)
+	assert.Equal(Version{Major: 1, Minor: 2, Patch: 3}, v)
+	assert.Equal("1.2.3", v.String())
+
+	v, err = ParseVersion("2")
+	assert.Nil(err)
+	assert.Equal("2.0.0", v.String())
+
+	v, err = ParseVersion("1.0.0-beta.1")
+	assert.Nil(err)
+	assert.Equal("beta.1", v.Pre)
+	assert.Equal(-1, v.Compare(Version{Major: 1}))
+
+	_, err = ParseVersion("1.x.0")
+	assert.NotNil(err)
+	_, err = ParseVersion("1.2.3.4")
+	assert.NotNil(err)
+}
+
+func TestVersionConstraint(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		constraint string
+		version    string
+		match      bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"1.2.3", "1.2.4", false},
+		{"1", "1.9.0", true},
+		{"1", "2.0.0", false},
+		{"1.2", "1.2.9", true},
+		{"1.2", "1.3.0", false},
+		{"^1.2", "1.9.0", true},
+		{"^1.2", "1.1.0", false},
+		{"^0.2", "0.3.0", false},
+		{"~1.2", "1.2.5", true},
+		{"~1.2", "1.3.0", false},
+		{">=1.0, <2", "1.5.0", true},
+		{">=1.0 <2", "2.0.0", false},
+		{">1.0.0", "1.0.0", false},
+		{"*", "3.0.0", true},
+		{"1.x", "1.4.0", true},
+	}
+	for _, c := range cases {
+		vc, err := ParseVersionConstraint(c.constraint)
+		assert.Nil(err, c.constraint)
+		v, err := ParseVersion(c.version)
+		assert.Nil(err)
+		assert.Equal(c.match, vc.Match(v), "%s matches %s", c.constraint, c.version)
+	}
+
+	_, err := ParseVersionConstraint("")
+	assert.NotNil(err)
+	_, err = ParseVersionConstraint("^abc")
+	assert.NotNil(err)
+
+	method, vstr := splitVersion("add@^1.2")
+	assert.Equal("add", method)
+	assert.Equal("^1.2", vstr)
+	method, vstr = splitVersion("add")
+	assert.Equal("add", method)
+	assert.Equal("", vstr)
+}
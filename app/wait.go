@@ -0,0 +1,85 @@
+package app
+
+import (
+	"context"
+	"time"
+)
+
+// servicesChanged returns a channel closed at the next change of
+// local or remote services
+func (self *Router) servicesChanged() <-chan struct{} {
+	self.changeLock.Lock()
+	defer self.changeLock.Unlock()
+	if self.changeChannel == nil {
+		self.changeChannel = make(chan struct{})
+	}
+	return self.changeChannel
+}
+
+// notifyServicesChanged wakes up the requests waiting for services
+func (self *Router) notifyServicesChanged() {
+	self.changeLock.Lock()
+	defer self.changeLock.Unlock()
+	if self.changeChannel != nil {
+		close(self.changeChannel)
+		self.changeChannel = nil
+	}
+}
+
+// hasProvider tells whether a local or remote service can serve the
+// method within ctx
+func (self *Router) hasProvider(ctx context.Context, method string, crit *selectCriteria) bool {
+	self.serviceLock.RLock()
+	shadow := self.shadowConfig(method)
+	for _, srv := range self.methodServicesIndex[method] {
+		if (shadow == nil || !shadow.inGroup(srv)) && crit.accept(method, srv) {
+			self.serviceLock.RUnlock()
+			return true
+		}
+	}
+	self.serviceLock.RUnlock()
+
+	if forwardHops(ctx) >= self.App().maxHops() {
+		return false
+	}
+	self.remoteServiceLock.RLock()
+	defer self.remoteServiceLock.RUnlock()
+	for _, rsrv := range self.methodRemoteServices[method] {
+		if crit.accept(method, rsrv) && rsrv.breaker.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceGrace returns how long a request of method waits for a
+// service
+func (self *Router) serviceGrace(method string) time.Duration {
+	return lookupMethodSetting(self.App().Config, self.namespace, method, func(m *MethodConfig) time.Duration {
+		return m.WaitForService
+	})
+}
+
+// waitProvider waits up to grace for a service to serve method,
+// returns false if none appears in time
+func (self *Router) waitProvider(ctx context.Context, method string, crit *selectCriteria, grace time.Duration) bool {
+	if grace <= 0 {
+		return self.hasProvider(ctx, method, crit)
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	for {
+		// get the channel before checking to not miss a change
+		changed := self.servicesChanged()
+		if self.hasProvider(ctx, method, crit) {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,22 @@
+// Package backoff computes the delays between the reconnects of node
+// links and workers
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Delay returns the delay before the attempt, doubled from min for
+// each attempt and capped by max, with full jitter within [delay/2,
+// delay)
+func Delay(attempt int, min time.Duration, max time.Duration) time.Duration {
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
@@ -0,0 +1,22 @@
+package backoff
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 10; i++ {
+		d := Delay(0, 100*time.Millisecond, time.Second)
+		assert.True(d >= 50*time.Millisecond && d < 100*time.Millisecond)
+
+		d = Delay(2, 100*time.Millisecond, time.Second)
+		assert.True(d >= 200*time.Millisecond && d < 400*time.Millisecond)
+
+		d = Delay(100, 100*time.Millisecond, time.Second)
+		assert.True(d >= 500*time.Millisecond && d < time.Second)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/superisaac/rpcmux/cmd/cmdutil"
 	"github.com/superisaac/rpcmux/playbook"
 	"os"
+	"strings"
 )
 
 func StartPlaybook() {
@@ -23,6 +24,15 @@ func StartPlaybook() {
 	// logging flags
 	pLogfile := flagset.String("log", "", "path to log output, default is stdout")
 
+	// credentials, override the auth section of playbook.yml, the
+	// server must be connected by ws, wss or h2 as h2c carries no
+	// credentials
+	pUser := flagset.String("user", "", "basic auth credentials, username:password")
+	pToken := flagset.String("token", "", "bearer token")
+	pCert := flagset.String("cert", "", "path to client cert file for mTLS")
+	pKey := flagset.String("key", "", "path to client key file for mTLS")
+	pCACert := flagset.String("cacert", "", "path to CA cert file verifying the server")
+
 	// parse command-line flags
 	flagset.Parse(os.Args[1:])
 	cmdutil.SetupLogger(*pLogfile)
@@ -34,6 +44,22 @@ func StartPlaybook() {
 		panic(err)
 	}
 
+	if *pUser != "" {
+		username, password, _ := strings.Cut(*pUser, ":")
+		pb.Config.Auth.Username = username
+		pb.Config.Auth.Password = password
+	}
+	if *pToken != "" {
+		pb.Config.Auth.Token = *pToken
+	}
+	if *pCert != "" {
+		pb.Config.Auth.CertFile = *pCert
+		pb.Config.Auth.KeyFile = *pKey
+	}
+	if *pCACert != "" {
+		pb.Config.Auth.CAFile = *pCACert
+	}
+
 	if err := pb.Run(context.Background(), *pConnect); err != nil {
 		panic(err)
 	}
@@ -57,7 +57,10 @@ func StartServer() {
 		signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
 		select {
 		case <-sigChannel:
-			log.Infof("application interrupted")
+			log.Infof("application interrupted, draining")
+			ctx, cancel := context.WithTimeout(rootCtx, application.DrainTimeout())
+			application.Drain(ctx)
+			cancel()
 			application.Stop()
 			time.Sleep(time.Second * 1)
 			os.Exit(0)
@@ -124,6 +124,9 @@ func (self *Playbook) Run(rootCtx context.Context, serverAddress string) error {
 		serverUrls[i] = serverAddress
 	}
 	w := worker.NewServiceWorker(serverUrls)
+	if err := self.Config.Auth.apply(w); err != nil {
+		return err
+	}
 
 	for name, method := range self.Config.Methods {
 		if !method.CanExecute() {
@@ -166,6 +169,26 @@ func (self *Playbook) Run(rootCtx context.Context, serverAddress string) error {
 		}
 	}
 
+	w.OnStateChange(func(serverUrl string, state worker.ConnState) {
+		log.Infof("playbook worker %s, server %s", state, serverUrl)
+	})
 	w.ConnectWait(rootCtx)
 	return nil
 }
+
+func (self AuthConfig) apply(w *worker.ServiceWorker) error {
+	if self.Username != "" {
+		if err := w.SetBasicAuth(self.Username, self.Password); err != nil {
+			return err
+		}
+	}
+	if self.Token != "" {
+		if err := w.SetBearerToken(self.Token); err != nil {
+			return err
+		}
+	}
+	if self.CertFile != "" {
+		return w.SetClientCert(self.CertFile, self.KeyFile, self.CAFile)
+	}
+	return nil
+}
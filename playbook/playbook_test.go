@@ -144,3 +144,16 @@ func TestPlaybookEndpoint(t *testing.T) {
 	assert.True(resmsg.IsResult())
 	assert.Equal("echo hi", resmsg.MustResult())
 }
+
+func TestPlaybookAuthH2C(t *testing.T) {
+	assert := assert.New(t)
+
+	pb := NewPlaybook()
+	assert.Nil(pb.Config.LoadBytes([]byte(PbSay)))
+	pb.Config.Auth.Token = "token1"
+
+	// the credentials would be dropped by h2c
+	err := pb.Run(context.Background(), "h2c://127.0.0.1:16004")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "h2c://127.0.0.1:16004")
+}
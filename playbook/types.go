@@ -27,8 +27,24 @@ type MethodConfig struct {
 	innerSchema     jsoffschema.Schema `yaml:"-"`
 }
 
+// credentials of the playbook worker, the namespace methods are
+// registered into comes from the auth settings on the server
+type AuthConfig struct {
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// bearer token, static or JWT
+	Token string `yaml:"token,omitempty"`
+
+	// client certificate for mTLS
+	CertFile string `yaml:"certfile,omitempty"`
+	KeyFile  string `yaml:"keyfile,omitempty"`
+	CAFile   string `yaml:"cafile,omitempty"`
+}
+
 type PlaybookConfig struct {
 	Version string                     `yaml:"version,omitempty"`
+	Auth    AuthConfig                 `yaml:"auth,omitempty"`
 	Methods map[string](*MethodConfig) `yaml:"methods,omitempty"`
 }
 
@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"context"
+	"github.com/superisaac/jsoff"
+)
+
+// ErrWorkerBusy rejects the requests over the queue limit, rpcmux
+// servers retry them on other workers by the code
+var ErrWorkerBusy = &jsoff.RPCError{Code: 214, Message: "worker busy", Data: nil}
+
+// limiter bounds the requests handled at once, the admitted requests
+// beyond the size wait for a slot
+type limiter struct {
+	slots    chan struct{}
+	inflight int
+}
+
+func newLimiter(size int) *limiter {
+	return &limiter{slots: make(chan struct{}, size)}
+}
+
+// SetConcurrency limits the requests the worker handles at once,
+// at most queueLimit more requests wait for a slot and the others are
+// rejected with ErrWorkerBusy. The capacity is declared to rpcmux servers
+// for balancing, must be called before connecting
+func (self *ServiceWorker) SetConcurrency(size int, queueLimit int) {
+	self.limiterLock.Lock()
+	defer self.limiterLock.Unlock()
+	if size > 0 {
+		self.limiter = newLimiter(size)
+	} else {
+		self.limiter = nil
+	}
+	if queueLimit < 0 {
+		queueLimit = 0
+	}
+	self.queueLimit = queueLimit
+}
+
+// SetMethodConcurrency limits the requests of a method handled at
+// once, the queue limit of the worker applies, must be called before
+// connecting
+func (self *ServiceWorker) SetMethodConcurrency(method string, size int) {
+	self.limiterLock.Lock()
+	defer self.limiterLock.Unlock()
+	self.options(method).Concurrency = size
+	delete(self.methodLimiters, method)
+}
+
+// capacity returns the requests the worker accepts at once, 0 is
+// unlimited
+func (self *ServiceWorker) capacity() int {
+	self.limiterLock.Lock()
+	defer self.limiterLock.Unlock()
+	if self.limiter == nil {
+		return 0
+	}
+	return cap(self.limiter.slots) + self.queueLimit
+}
+
+// admit counts a request of the method in, returns false if the
+// queue of any limiter is full. The method limiter comes first so
+// that requests waiting for a method slot hold no worker slot,
+// internal methods such as _ping are not limited
+func (self *ServiceWorker) admit(method string) ([]*limiter, bool) {
+	limiters := []*limiter{}
+	if !jsoff.IsPublicMethod(method) {
+		return limiters, true
+	}
+	self.limiterLock.Lock()
+	defer self.limiterLock.Unlock()
+	if opts, ok := self.methodOptions[method]; ok && opts.Concurrency > 0 {
+		l, ok := self.methodLimiters[method]
+		if !ok {
+			l = newLimiter(opts.Concurrency)
+			self.methodLimiters[method] = l
+		}
+		limiters = append(limiters, l)
+	}
+	if self.limiter != nil {
+		limiters = append(limiters, self.limiter)
+	}
+	for _, l := range limiters {
+		if l.inflight >= cap(l.slots)+self.queueLimit {
+			return nil, false
+		}
+	}
+	for _, l := range limiters {
+		l.inflight++
+	}
+	return limiters, true
+}
+
+// acquire waits for slots of the admitted limiters, returns how many
+// slots are taken
+func (self *ServiceWorker) acquire(ctx context.Context, limiters []*limiter) (int, error) {
+	for i, l := range limiters {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return i, ctx.Err()
+		}
+	}
+	return len(limiters), nil
+}
+
+// release frees the slots taken and counts the request out
+func (self *ServiceWorker) release(limiters []*limiter, taken int) {
+	for _, l := range limiters[:taken] {
+		<-l.slots
+	}
+	self.limiterLock.Lock()
+	defer self.limiterLock.Unlock()
+	for _, l := range limiters {
+		l.inflight--
+	}
+}
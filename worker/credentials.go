@@ -0,0 +1,88 @@
+package worker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// SetBasicAuth sends the username and password to rpcmux servers, the
+// namespace of the worker comes from the auth settings of the user
+func (self *ServiceWorker) SetBasicAuth(username string, password string) error {
+	cred := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return self.setHeader("Authorization", "Basic "+cred)
+}
+
+// SetBearerToken sends a bearer token, either a static token or a
+// JWT, to rpcmux servers
+func (self *ServiceWorker) SetBearerToken(token string) error {
+	return self.setHeader("Authorization", "Bearer "+token)
+}
+
+// SetClientCert presents a client certificate to rpcmux servers
+// requiring mTLS, caFile verifies the servers if not empty
+func (self *ServiceWorker) SetClientCert(certFile string, keyFile string, caFile string) error {
+	if err := self.checkCredentials(); err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return errors.Wrap(err, "load client cert")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return errors.Wrap(err, "read ca file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certs in ca file")
+		}
+		cfg.RootCAs = pool
+	}
+	self.clientLock.Lock()
+	defer self.clientLock.Unlock()
+	self.tlsConfig = cfg
+	for _, client := range self.clients {
+		client.SetClientTLSConfig(cfg)
+	}
+	return nil
+}
+
+// checkCredentials rejects the credentials if any server is connected
+// by h2c, the h2c preface carries no headers and no TLS
+func (self *ServiceWorker) checkCredentials() error {
+	for _, serverUrl := range self.serverUrls {
+		u, err := url.Parse(serverUrl)
+		if err != nil {
+			return errors.Wrap(err, "parse server url")
+		}
+		if u.Scheme == "h2c" {
+			return errors.Errorf("credentials cannot be sent to %s, connect by ws, wss or h2", serverUrl)
+		}
+	}
+	return nil
+}
+
+func (self *ServiceWorker) setHeader(key string, value string) error {
+	if err := self.checkCredentials(); err != nil {
+		return err
+	}
+	self.clientLock.Lock()
+	defer self.clientLock.Unlock()
+	if self.header == nil {
+		self.header = http.Header{}
+	}
+	self.header.Set(key, value)
+	for _, client := range self.clients {
+		client.SetExtraHeader(self.header.Clone())
+	}
+	return nil
+}
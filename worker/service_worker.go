@@ -6,7 +6,11 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jsoff"
 	"github.com/superisaac/jsoff/net"
+	"github.com/superisaac/rpcmux/backoff"
+	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 func NewServiceWorker(serverUrls []string) *ServiceWorker {
@@ -18,8 +22,14 @@ func NewServiceWorkerWithActor(serverUrls []string, actor *jsoffnet.Actor) *Serv
 		actor = jsoffnet.NewActor()
 	}
 	worker := &ServiceWorker{
-		Actor:   actor,
-		clients: []jsoffnet.Streamable{},
+		Actor:          actor,
+		serverUrls:     serverUrls,
+		clients:        []jsoffnet.Streamable{},
+		methodOptions:  make(map[string]*MethodOptions),
+		labels:         make(map[string]string),
+		methodLimiters: make(map[string]*limiter),
+		handlers:       make(map[string]*jsoffnet.Actor),
+		declared:       make(map[jsoffnet.Streamable]bool),
 	}
 
 	for _, serverUrl := range serverUrls {
@@ -32,6 +42,69 @@ func NewServiceWorkerWithActor(serverUrls []string, actor *jsoffnet.Actor) *Serv
 	return worker
 }
 
+func (self *ServiceWorker) options(method string) *MethodOptions {
+	opts, ok := self.methodOptions[method]
+	if !ok {
+		opts = &MethodOptions{}
+		self.methodOptions[method] = opts
+	}
+	return opts
+}
+
+// SetTimeout declares the timeout of a method to rpcmux servers,
+// must be called before connecting
+func (self *ServiceWorker) SetTimeout(method string, timeout time.Duration) {
+	self.options(method).Timeout = timeout.Seconds()
+}
+
+// SetDelivery declares the delivery mode of a notify method to rpcmux
+// servers, must be called before connecting
+func (self *ServiceWorker) SetDelivery(method string, delivery string) {
+	self.options(method).Delivery = delivery
+}
+
+// SetVersion declares the version of a method to rpcmux servers, a
+// method can also be versioned by its name such as add@1.2.0, must be
+// called before connecting
+func (self *ServiceWorker) SetVersion(method string, version string) {
+	self.options(method).Version = version
+}
+
+// SetLabel declares a label of the worker to rpcmux servers, such as
+// track: canary for traffic splitting, must be called before
+// connecting
+func (self *ServiceWorker) SetLabel(key string, value string) {
+	self.labels[key] = value
+}
+
+// SetMetadata declares the metadata of the worker to rpcmux servers,
+// the hostname defaults to the host's name, must be called before
+// connecting
+func (self *ServiceWorker) SetMetadata(metadata ServiceMetadata) {
+	self.metadata = metadata
+}
+
+// OnStateChange sets the callback of connection state changes, called
+// with the server url and the new state
+func (self *ServiceWorker) OnStateChange(callback func(serverUrl string, state ConnState)) {
+	self.onStateChange = callback
+}
+
+func (self *ServiceWorker) setState(serverUrl string, state ConnState) {
+	log.Debugf("worker %s, server %s", state, serverUrl)
+	if self.onStateChange != nil {
+		self.onStateChange(serverUrl, state)
+	}
+}
+
+// currentClients returns the clients in use, a client is replaced
+// when reconnecting
+func (self *ServiceWorker) currentClients() []jsoffnet.Streamable {
+	self.clientLock.Lock()
+	defer self.clientLock.Unlock()
+	return append([]jsoffnet.Streamable{}, self.clients...)
+}
+
 func (self *ServiceWorker) initClient(serverUrl string) jsoffnet.Streamable {
 	client, err := jsoffnet.NewClient(serverUrl)
 	if err != nil {
@@ -41,6 +114,15 @@ func (self *ServiceWorker) initClient(serverUrl string) jsoffnet.Streamable {
 	if !ok {
 		log.Panicf("client is not streamable")
 	}
+	// a client replaced when reconnecting gets the credentials too
+	self.clientLock.Lock()
+	if self.header != nil {
+		sc.SetExtraHeader(self.header.Clone())
+	}
+	if self.tlsConfig != nil {
+		sc.SetClientTLSConfig(self.tlsConfig)
+	}
+	self.clientLock.Unlock()
 	sc.OnMessage(func(msg jsoff.Message) {
 		err := self.feed(msg, sc)
 		if err != nil {
@@ -60,14 +142,94 @@ func (self *ServiceWorker) initClient(serverUrl string) jsoffnet.Streamable {
 }
 
 func (self *ServiceWorker) feed(msg jsoff.Message, client jsoffnet.Streamable) error {
-	req := jsoffnet.NewRPCRequest(self.connCtx, msg, jsoffnet.TransportHTTP)
+	ctx := self.connCtx
+	if ctx == nil {
+		// worker disconnected
+		return nil
+	}
+	if msg.IsNotify() && msg.MustMethod() == "rpcmux.cancel" {
+		self.cancelRequest(msg.MustParams())
+		return nil
+	}
+	if msg.IsNotify() && msg.MustMethod() == "rpcmux.dismissed" {
+		// reconnect to be served again
+		if v, ok := self.connections.Load(client); ok {
+			log.Warnf("worker dismissed by server, reconnect")
+			cancel, _ := v.(context.CancelFunc)
+			cancel()
+		}
+		return nil
+	}
+	if msg.IsNotify() && msg.MustMethod() == "rpcmux.drained" {
+		if v, ok := self.drained.LoadAndDelete(client); ok {
+			ch, _ := v.(chan struct{})
+			close(ch)
+		}
+		return nil
+	}
+	if msg.IsRequest() {
+		limiters, ok := self.admit(msg.MustMethod())
+		if !ok {
+			reqmsg, _ := msg.(*jsoff.RequestMessage)
+			msg.Log().Debugf("worker busy, request rejected")
+			client.Send(ctx, ErrWorkerBusy.ToMessage(reqmsg))
+			return nil
+		}
+		// run the handler aside with a context cancelled by
+		// rpcmux.cancel
+		reqId, _ := msg.MustId().(string)
+		reqCtx, cancel := context.WithCancel(ctx)
+		if reqId != "" {
+			self.running.Store(reqId, cancel)
+		}
+		go func() {
+			defer self.running.Delete(reqId)
+			defer cancel()
+			taken, err := self.acquire(reqCtx, limiters)
+			defer self.release(limiters, taken)
+			if err != nil {
+				msg.Log().Debugf("request cancelled while queued")
+				return
+			}
+			if err := self.handle(reqCtx, msg, client); err != nil {
+				msg.Log().Errorf("handle error %s", err)
+			}
+		}()
+		return nil
+	}
+	return self.handle(ctx, msg, client)
+}
 
-	resmsg, err := self.Actor.Feed(req)
+// cancelRequest cancels the context of a running request
+func (self *ServiceWorker) cancelRequest(params []interface{}) {
+	if len(params) == 0 {
+		return
+	}
+	reqId, _ := params[0].(string)
+	if v, ok := self.running.Load(reqId); ok {
+		cancel, _ := v.(context.CancelFunc)
+		log.Debugf("request %s cancelled by server", reqId)
+		cancel()
+	}
+}
+
+func (self *ServiceWorker) handle(ctx context.Context, msg jsoff.Message, client jsoffnet.Streamable) error {
+	req := jsoffnet.NewRPCRequest(ctx, msg, jsoffnet.TransportHTTP)
+
+	actor := self.Actor
+	if msg.IsRequest() || msg.IsNotify() {
+		actor = self.actorOf(msg.MustMethod())
+	}
+	resmsg, err := actor.Feed(req)
 	if err != nil {
 		return err
 	}
 	if resmsg != nil {
-		client.Send(self.connCtx, resmsg)
+		if ctx.Err() != nil {
+			msg.Log().Debugf("request cancelled or worker disconnected, drop the response")
+			return nil
+		}
+		client.Send(ctx, resmsg)
 	}
 	return nil
 }
@@ -89,49 +251,264 @@ func (self *ServiceWorker) ConnectWait(rootCtx context.Context) {
 
 	wg := &sync.WaitGroup{}
 
-	for i, client := range self.clients {
+	for i := range self.serverUrls {
 		wg.Add(1)
-		go func(idx int, c jsoffnet.Streamable) {
-			err := self.connectClient(ctx, wg, c)
-			if err != nil {
-				log.Errorf("error connect client %d: %s", idx, err)
-			}
-		}(i, client)
+		go self.runClient(ctx, wg, i)
 	}
 	wg.Wait()
 }
 
-func (self *ServiceWorker) connectClient(rootCtx context.Context, wg *sync.WaitGroup, client jsoffnet.Streamable) error {
+// runClient keeps the idx-th client connected until ctx is done, the
+// client reconnects with backoff and declares methods again
+func (self *ServiceWorker) runClient(ctx context.Context, wg *sync.WaitGroup, idx int) {
 	defer wg.Done()
+	serverUrl := self.serverUrls[idx]
+	for attempt := 0; ; {
+		self.clientLock.Lock()
+		client := self.clients[idx]
+		self.clientLock.Unlock()
+
+		self.setState(serverUrl, StateConnecting)
+		declared, err := self.connectClient(ctx, client, serverUrl)
+		self.setState(serverUrl, StateDisconnected)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("client %s error: %s", serverUrl, err)
+		}
+		if declared {
+			attempt = 0
+		}
+		delay := backoff.Delay(attempt, reconnectMinBackoff, reconnectMaxBackoff)
+		attempt++
+		log.Infof("reconnect to %s after %s", serverUrl, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
 
+		// a closed client is not reusable
+		newClient := self.initClient(serverUrl)
+		self.clientLock.Lock()
+		self.clients[idx] = newClient
+		self.clientLock.Unlock()
+	}
+}
+
+// connectClient connects and declares methods, then waits until the
+// connection drops, returns whether methods are declared
+func (self *ServiceWorker) connectClient(rootCtx context.Context, client jsoffnet.Streamable, serverUrl string) (bool, error) {
 	ctx, cancel := context.WithCancel(rootCtx)
 	defer cancel()
+	self.connections.Store(client, cancel)
+	defer self.connections.Delete(client)
 
 	err := client.Connect(ctx)
 	if err != nil {
+		return false, err
+	}
+
+	if err := self.declare(ctx, client); err != nil {
+		return false, err
+	}
+	self.setState(serverUrl, StateConnected)
+
+	err = client.Wait()
+	self.declareLock.Lock()
+	delete(self.declared, client)
+	self.declareLock.Unlock()
+	return true, err
+}
+
+// declare declares methods to the server connected by client
+func (self *ServiceWorker) declare(ctx context.Context, client jsoffnet.Streamable) error {
+	self.declareLock.Lock()
+	defer self.declareLock.Unlock()
+
+	methods, methodOptions := self.declaredMethods(self.publicMethods())
+	declareOptions := map[string]interface{}{
+		"methods": methodOptions,
+	}
+	if len(self.labels) > 0 {
+		declareOptions["labels"] = self.labels
+	}
+	metadata := self.metadata
+	if metadata.Hostname == "" {
+		metadata.Hostname, _ = os.Hostname()
+	}
+	if metadata.Capacity == 0 {
+		metadata.Capacity = self.capacity()
+	}
+	declareOptions["metadata"] = metadata
+	reqmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), "rpcmux.declare", []interface{}{methods, declareOptions})
+	if err := self.callServer(ctx, client, reqmsg); err != nil {
 		return err
 	}
+	self.declared[client] = true
+	return nil
+}
 
-	// declare methods
-	methods := map[string]interface{}{}
+// Drain asks rpcmux servers to send no more requests, waits until the
+// servers tell the pending requests are done and then disconnects
+func (self *ServiceWorker) Drain(ctx context.Context) error {
+	channels := []chan struct{}{}
+	for _, client := range self.currentClients() {
+		ch := make(chan struct{})
+		self.drained.Store(client, ch)
+		channels = append(channels, ch)
+		reqmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), "rpcmux.drain", []interface{}{})
+		if err := self.callServer(ctx, client, reqmsg); err != nil {
+			self.drained.Delete(client)
+			return err
+		}
+	}
+	for _, ch := range channels {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if self.cancelFunc != nil {
+		self.cancelFunc()
+	}
+	return nil
+}
+
+// AddHandler registers the handler of a method and declares the
+// method to the connected servers, handlers registered to Actor after
+// connecting are neither declared nor safe to call
+func (self *ServiceWorker) AddHandler(ctx context.Context, method string, callback jsoffnet.MsgCallback, setters ...jsoffnet.HandlerSetter) error {
+	actor := self.newActor()
+	actor.On(method, callback, setters...)
+	return self.addActor(ctx, method, actor)
+}
+
+// AddTypedHandler registers a typed handler like Actor.OnTyped and
+// declares the method to the connected servers
+func (self *ServiceWorker) AddTypedHandler(ctx context.Context, method string, typedHandler interface{}, setters ...jsoffnet.HandlerSetter) error {
+	actor := self.newActor()
+	actor.OnTyped(method, typedHandler, setters...)
+	return self.addActor(ctx, method, actor)
+}
+
+// RemoveHandler unregisters the handler of a method and removes the
+// method from the connected servers
+func (self *ServiceWorker) RemoveHandler(ctx context.Context, method string) error {
+	self.declareLock.Lock()
+	defer self.declareLock.Unlock()
+
+	self.handlerLock.Lock()
+	self.handlers[method] = self.newActor()
+	self.handlerLock.Unlock()
+
+	if !isPublicName(method) {
+		return nil
+	}
+	return self.declareToServers(ctx, func() *jsoff.RequestMessage {
+		return jsoff.NewRequestMessage(jsoff.NewUuid(), "rpcmux.declare_remove", []interface{}{[]string{method}})
+	})
+}
+
+func (self *ServiceWorker) newActor() *jsoffnet.Actor {
+	actor := jsoffnet.NewActor()
+	actor.ValidateSchema = self.Actor.ValidateSchema
+	actor.RecoverFromPanic = self.Actor.RecoverFromPanic
+	return actor
+}
+
+func (self *ServiceWorker) addActor(ctx context.Context, method string, actor *jsoffnet.Actor) error {
+	self.declareLock.Lock()
+	defer self.declareLock.Unlock()
+
+	self.handlerLock.Lock()
+	self.handlers[method] = actor
+	self.handlerLock.Unlock()
+
+	if !isPublicName(method) {
+		return nil
+	}
+	return self.declareToServers(ctx, func() *jsoff.RequestMessage {
+		methods, methodOptions := self.declaredMethods([]string{method})
+		declareOptions := map[string]interface{}{
+			"methods": methodOptions,
+		}
+		return jsoff.NewRequestMessage(jsoff.NewUuid(), "rpcmux.declare_add", []interface{}{methods, declareOptions})
+	})
+}
+
+// declareToServers calls the servers with methods declared, the
+// servers connected later get the methods by rpcmux.declare
+func (self *ServiceWorker) declareToServers(ctx context.Context, newRequest func() *jsoff.RequestMessage) error {
+	var lastErr error
+	for client := range self.declared {
+		if err := self.callServer(ctx, client, newRequest()); err != nil {
+			log.Errorf("declare methods error %s", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// actorOf returns the actor handling a method
+func (self *ServiceWorker) actorOf(method string) *jsoffnet.Actor {
+	self.handlerLock.RLock()
+	defer self.handlerLock.RUnlock()
+	if actor, ok := self.handlers[method]; ok {
+		return actor
+	}
+	return self.Actor
+}
+
+// publicMethods returns the public methods handled, the version part
+// of a name such as add@1.2.0 is not checked
+func (self *ServiceWorker) publicMethods() []string {
+	self.handlerLock.RLock()
+	defer self.handlerLock.RUnlock()
+	names := []string{}
 	for _, mname := range self.Actor.MethodList() {
-		if !jsoff.IsPublicMethod(mname) {
-			continue
+		if _, ok := self.handlers[mname]; !ok && isPublicName(mname) {
+			names = append(names, mname)
+		}
+	}
+	for mname, actor := range self.handlers {
+		if actor.Has(mname) && isPublicName(mname) {
+			names = append(names, mname)
 		}
-		if s, ok := self.Actor.GetSchema(mname); ok {
+	}
+	return names
+}
+
+func isPublicName(mname string) bool {
+	return jsoff.IsPublicMethod(strings.SplitN(mname, "@", 2)[0])
+}
+
+// declaredMethods returns the schemas and options of methods to
+// declare
+func (self *ServiceWorker) declaredMethods(names []string) (map[string]interface{}, map[string]interface{}) {
+	methods := map[string]interface{}{}
+	methodOptions := map[string]interface{}{}
+	for _, mname := range names {
+		if s, ok := self.actorOf(mname).GetSchema(mname); ok {
 			methods[mname] = s.Map()
 		} else {
 			methods[mname] = nil
 		}
+		if opts, ok := self.methodOptions[mname]; ok {
+			methodOptions[mname] = opts
+		}
 	}
-	reqmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), "rpcmux.declare", []interface{}{methods})
+	return methods, methodOptions
+}
+
+func (self *ServiceWorker) callServer(ctx context.Context, client jsoffnet.Streamable, reqmsg *jsoff.RequestMessage) error {
 	resmsg, err := client.Call(ctx, reqmsg)
 	if err != nil {
 		return err
 	} else if resmsg.IsError() {
 		return resmsg.MustError()
 	}
-	// resmsg should be "ok"
-
-	return client.Wait()
+	return nil
 }
@@ -2,13 +2,109 @@ package worker
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/superisaac/jsoff/net"
+	"net/http"
+	"sync"
+	"time"
 )
 
+const (
+	reconnectMinBackoff = time.Millisecond * 100
+	reconnectMaxBackoff = time.Second * 10
+)
+
+// connection states of a worker to a server
+type ConnState string
+
+const (
+	StateConnecting ConnState = "connecting"
+
+	// connected and methods declared
+	StateConnected ConnState = "connected"
+
+	StateDisconnected ConnState = "disconnected"
+)
+
+// delivery modes of notify methods
+const (
+	// every replica of the method gets the notify
+	DeliveryBroadcast = "broadcast"
+
+	// one replica cluster-wide gets the notify
+	DeliveryAny = "any"
+)
+
+// options of a method declared to rpcmux servers
+type MethodOptions struct {
+	// timeout in seconds
+	Timeout float64 `json:"timeout,omitempty"`
+
+	Delivery string `json:"delivery,omitempty"`
+
+	// semantic version such as 1.2.0
+	Version string `json:"version,omitempty"`
+
+	// requests of the method handled at once, 0 is unlimited
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// metadata of a worker declared to rpcmux servers, version, zone
+// and hostname can be selected like labels, such as zone=eu
+type ServiceMetadata struct {
+	// the version of the worker itself
+	Version  string `json:"version,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+
+	// relative weight used by weighted balancers
+	Weight int `json:"weight,omitempty"`
+
+	// requests the worker accepts at once, set by SetConcurrency
+	// unless given
+	Capacity int `json:"capacity,omitempty"`
+}
+
 // client side structures
 type ServiceWorker struct {
-	Actor      *jsoffnet.Actor
-	clients    []jsoffnet.Streamable
-	cancelFunc func()
-	connCtx    context.Context
+	Actor         *jsoffnet.Actor
+	serverUrls    []string
+	clientLock    sync.Mutex
+	clients       []jsoffnet.Streamable
+	cancelFunc    func()
+	connCtx       context.Context
+	methodOptions map[string]*MethodOptions
+	labels        map[string]string
+	metadata      ServiceMetadata
+
+	// request id => cancel func of running requests
+	running sync.Map
+
+	// client => channel closed by rpcmux.drained
+	drained sync.Map
+
+	// client => cancel func of the connection, called when the
+	// server dismisses the worker by rpcmux.dismissed
+	connections sync.Map
+
+	onStateChange func(serverUrl string, state ConnState)
+
+	// credentials sent to servers
+	header    http.Header
+	tlsConfig *tls.Config
+
+	// handlers added or removed after connecting, a removed handler
+	// is an empty actor
+	handlerLock sync.RWMutex
+	handlers    map[string]*jsoffnet.Actor
+
+	// serializes declarations, clients with methods declared
+	declareLock sync.Mutex
+	declared    map[jsoffnet.Streamable]bool
+
+	// bound the requests handled at once
+	limiterLock    sync.Mutex
+	limiter        *limiter
+	methodLimiters map[string]*limiter
+	queueLimit     int
 }
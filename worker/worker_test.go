@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/superisaac/jsoff"
@@ -10,6 +11,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -210,3 +212,1196 @@ func TestRemoteServersStopApp(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal([]string{}, methodsres2.Remotes)
 }
+
+func TestWorkerTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	// start rpcmux server
+	actor := app.NewActor()
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(rootCtx, actor, true)
+	go jsoffnet.ListenAndServe(rootCtx, "127.0.0.1:16031", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	// prepare worker and connect to rpcmux server
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16031"})
+	worker.Actor.OnTyped("slowEcho", func(text string) (string, error) {
+		time.Sleep(500 * time.Millisecond)
+		return "echo: " + text, nil
+	})
+	worker.SetTimeout("slowEcho", 200*time.Millisecond)
+	go worker.ConnectWait(rootCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16031")
+	assert.Nil(err)
+
+	// the worker declared timeout is hit
+	reqmsg := jsoff.NewRequestMessage(1, "slowEcho", []interface{}{"hi"})
+	resmsg, err := c.Call(rootCtx, reqmsg)
+	assert.Nil(err)
+	assert.True(resmsg.IsError())
+	assert.Equal(jsoff.ErrTimeout.Code, resmsg.MustError().Code)
+	assert.Contains(resmsg.MustError().Message, "worker")
+
+	// the caller's timeout is less than the worker's
+	h := http.Header{}
+	h.Set("X-Rpcmux-Timeout", "50ms")
+	c.SetExtraHeader(h)
+	reqmsg1 := jsoff.NewRequestMessage(2, "slowEcho", []interface{}{"hi"})
+	resmsg1, err := c.Call(rootCtx, reqmsg1)
+	assert.Nil(err)
+	assert.True(resmsg1.IsError())
+	assert.Contains(resmsg1.MustError().Message, "caller")
+}
+
+func TestWorkerFailover(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Balance = "round_robin"
+	app1.Config.Router.Retry = &app.RetryConfig{MaxAttempts: 2}
+	idempotent := true
+	app1.Config.Router.Methods = map[string]*app.MethodConfig{
+		"whoami": &app.MethodConfig{Idempotent: &idempotent},
+	}
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16041", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	// worker1 disconnects in the middle of a call
+	worker1Ctx, cancelWorker1 := context.WithCancel(rootCtx)
+	worker1 := NewServiceWorker([]string{"h2c://127.0.0.1:16041"})
+	worker1.Actor.OnTyped("whoami", func() (string, error) {
+		cancelWorker1()
+		time.Sleep(200 * time.Millisecond)
+		return "worker1", nil
+	})
+	go worker1.ConnectWait(worker1Ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	worker2 := NewServiceWorker([]string{"h2c://127.0.0.1:16041"})
+	worker2.Actor.OnTyped("whoami", func() (string, error) {
+		return "worker2", nil
+	})
+	go worker2.ConnectWait(rootCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16041")
+	assert.Nil(err)
+
+	reqmsg := jsoff.NewRequestMessage(1, "whoami", nil)
+	resmsg, err := c.Call(rootCtx, reqmsg)
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+	assert.Equal("worker2", resmsg.MustResult())
+}
+
+func TestForward(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Cluster.Secret = "nodesecret"
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16051", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16051"})
+	worker.Actor.OnTyped("echo", func(text string) (string, error) {
+		return "echo: " + text, nil
+	})
+	go worker.ConnectWait(rootCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	envelope := map[string]interface{}{
+		"namespace": "default",
+		"hops":      1,
+		"id":        "orig-1",
+		"method":    "echo",
+		"params":    []interface{}{"hi"},
+	}
+
+	// forward without the node secret
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16051")
+	assert.Nil(err)
+	reqmsg := jsoff.NewRequestMessage(1, "rpcmux.forward", []interface{}{envelope})
+	resmsg, err := c.Call(rootCtx, reqmsg)
+	assert.Nil(err)
+	assert.True(resmsg.IsError())
+	assert.Equal(jsoff.ErrAuthFailed.Code, resmsg.MustError().Code)
+
+	// forward with the node secret
+	h := http.Header{}
+	h.Set("Authorization", "Bearer nodesecret")
+	c.SetExtraHeader(h)
+	reqmsg1 := jsoff.NewRequestMessage(2, "rpcmux.forward", []interface{}{envelope})
+	resmsg1, err := c.Call(rootCtx, reqmsg1)
+	assert.Nil(err)
+	assert.True(resmsg1.IsResult())
+	assert.Equal("echo: hi", resmsg1.MustResult())
+
+	// a forwarded message targets the namespace in envelope
+	envelope["namespace"] = "eastasia"
+	reqmsg2 := jsoff.NewRequestMessage(3, "rpcmux.forward", []interface{}{envelope})
+	resmsg2, err := c.Call(rootCtx, reqmsg2)
+	assert.Nil(err)
+	assert.True(resmsg2.IsError())
+	assert.Equal(jsoff.ErrMethodNotFound.Code, resmsg2.MustError().Code)
+}
+
+func TestAdminMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16081", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16081"})
+	worker.Actor.OnTyped("echo", func(text string) (string, error) {
+		return "echo: " + text, nil
+	})
+	go worker.ConnectWait(rootCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16081")
+	assert.Nil(err)
+
+	resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "rpcmux.services", nil))
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+	services, _ := resmsg.MustResult().([]interface{})
+	assert.Equal(1, len(services))
+	srvinfo, _ := services[0].(map[string]interface{})
+	assert.Equal([]interface{}{"echo"}, srvinfo["methods"])
+	assert.NotEqual("", srvinfo["remote_addr"])
+
+	resmsg1, err := c.Call(rootCtx, jsoff.NewRequestMessage(2, "rpcmux.nodes", nil))
+	assert.Nil(err)
+	assert.True(resmsg1.IsResult())
+	assert.Equal([]interface{}{}, resmsg1.MustResult())
+}
+
+func TestWorkerBroadcast(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16101", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	var invalidated, touched int32
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+	for i := 0; i < 3; i++ {
+		worker := NewServiceWorker([]string{"h2c://127.0.0.1:16101"})
+		worker.Actor.On("invalidate", func(params []interface{}) (interface{}, error) {
+			atomic.AddInt32(&invalidated, 1)
+			return nil, nil
+		})
+		worker.Actor.On("touch", func(params []interface{}) (interface{}, error) {
+			atomic.AddInt32(&touched, 1)
+			return nil, nil
+		})
+		worker.SetDelivery("invalidate", DeliveryBroadcast)
+		go worker.ConnectWait(workerCtx)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16101")
+	assert.Nil(err)
+
+	// a broadcast notify reaches every worker
+	err = c.Send(rootCtx, jsoff.NewNotifyMessage("invalidate", []interface{}{"key1"}))
+	assert.Nil(err)
+
+	// a notify of the default mode reaches one worker
+	err = c.Send(rootCtx, jsoff.NewNotifyMessage("touch", []interface{}{"key1"}))
+	assert.Nil(err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(int32(3), atomic.LoadInt32(&invalidated))
+	assert.Equal(int32(1), atomic.LoadInt32(&touched))
+}
+
+const addSchema = `
+---
+type: method
+params:
+  - type: number
+    name: a
+  - type: number
+    name: b
+`
+
+func TestWorkerValidateParams(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16111", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	var received int32
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16111"})
+	worker.Actor.OnTyped("add", func(a, b float64) (float64, error) {
+		atomic.AddInt32(&received, 1)
+		return a + b, nil
+	}, jsoffnet.WithSchemaYaml(addSchema))
+	go worker.ConnectWait(rootCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16111")
+	assert.Nil(err)
+
+	resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "add", []interface{}{1, 2}))
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+	assert.Equal(json.Number("3"), resmsg.MustResult())
+
+	// the router rejects bad params without calling the worker
+	resmsg1, err := c.Call(rootCtx, jsoff.NewRequestMessage(2, "add", []interface{}{"x", 2}))
+	assert.Nil(err)
+	assert.True(resmsg1.IsError())
+	rpcErr := resmsg1.MustError()
+	assert.Equal(-32602, rpcErr.Code)
+	data, _ := rpcErr.Data.(map[string]interface{})
+	assert.Equal(".params[0]", data["path"])
+
+	// so are notifies
+	err = c.Send(rootCtx, jsoff.NewNotifyMessage("add", []interface{}{1}))
+	assert.Nil(err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&received))
+}
+
+const greetSchema = `
+---
+type: method
+params:
+  - type: string
+    name: name
+returns:
+  type: string
+`
+
+func TestWorkerValidateReturns(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Methods = map[string]*app.MethodConfig{
+		"greet":      {ValidateReturns: app.ReturnsEnforce},
+		"greetLoose": {ValidateReturns: app.ReturnsLog},
+	}
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16121", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	// the workers drift from the contract and return numbers
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16121"})
+	worker.Actor.OnTyped("greet", func(name string) (int, error) {
+		return 1, nil
+	}, jsoffnet.WithSchemaYaml(greetSchema))
+	worker.Actor.OnTyped("greetLoose", func(name string) (int, error) {
+		return 2, nil
+	}, jsoffnet.WithSchemaYaml(greetSchema))
+	go worker.ConnectWait(rootCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16121")
+	assert.Nil(err)
+
+	// enforced
+	resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "greet", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.True(resmsg.IsError())
+	assert.Equal(jsoff.ErrServerError.Code, resmsg.MustError().Code)
+
+	// logged only
+	resmsg1, err := c.Call(rootCtx, jsoff.NewRequestMessage(2, "greetLoose", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.True(resmsg1.IsResult())
+	assert.Equal(json.Number("2"), resmsg1.MustResult())
+
+	var metrics map[string]map[string]int
+	err = c.UnwrapCall(rootCtx, jsoff.NewRequestMessage(3, "rpcmux.metrics", nil), &metrics)
+	assert.Nil(err)
+	assert.Equal(map[string]int{"greet": 1, "greetLoose": 1}, metrics["returns_violations"])
+}
+
+func TestWorkerVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Methods = map[string]*app.MethodConfig{
+		"greet": {Version: "1"},
+	}
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16141", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	// versioned by name
+	worker1 := NewServiceWorker([]string{"h2c://127.0.0.1:16141"})
+	worker1.Actor.OnTyped("greet@1.0.0", func(name string) (string, error) {
+		return "v1 hello " + name, nil
+	})
+	go worker1.ConnectWait(workerCtx)
+
+	// versioned by options
+	worker2 := NewServiceWorker([]string{"h2c://127.0.0.1:16141"})
+	worker2.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "v2 hello " + name, nil
+	})
+	worker2.SetVersion("greet", "2.1.0")
+	go worker2.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16141")
+	assert.Nil(err)
+
+	callGreet := func(method string) jsoff.Message {
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, method, []interface{}{"jack"}))
+		assert.Nil(err)
+		return resmsg
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal("v1 hello jack", callGreet("greet@1").MustResult())
+		assert.Equal("v2 hello jack", callGreet("greet@^2.0").MustResult())
+		// the configured default version
+		assert.Equal("v1 hello jack", callGreet("greet").MustResult())
+	}
+
+	resmsg := callGreet("greet@3")
+	assert.True(resmsg.IsError())
+	assert.Equal(jsoff.ErrMethodNotFound.Code, resmsg.MustError().Code)
+
+	methodsres := struct {
+		Methods  []string
+		Versions map[string][]string
+	}{}
+	err = c.UnwrapCall(rootCtx, jsoff.NewRequestMessage(2, "rpcmux.methods", nil), &methodsres)
+	assert.Nil(err)
+	assert.Equal([]string{"1.0.0", "2.1.0"}, methodsres.Versions["greet"])
+}
+
+func TestWorkerSplit(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Methods = map[string]*app.MethodConfig{
+		"greet": {Split: &app.SplitConfig{Weights: map[string]int{"stable": 1}}},
+	}
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16151", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	for _, track := range []string{"stable", "canary"} {
+		reply := track + " hello "
+		w := NewServiceWorker([]string{"h2c://127.0.0.1:16151"})
+		w.Actor.OnTyped("greet", func(name string) (string, error) {
+			return reply + name, nil
+		})
+		w.SetLabel("track", track)
+		go w.ConnectWait(workerCtx)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16151")
+	assert.Nil(err)
+
+	callGreet := func() interface{} {
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "greet", []interface{}{"jack"}))
+		assert.Nil(err)
+		if resmsg.IsError() {
+			return resmsg.MustError().Message
+		}
+		return resmsg.MustResult()
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal("stable hello jack", callGreet())
+	}
+
+	// move all traffic to canary
+	resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(2, "rpcmux.split", []interface{}{
+		"greet", map[string]interface{}{"canary": 1, "stable": 0}}))
+	assert.Nil(err)
+	assert.Equal("ok", resmsg.MustResult())
+	for i := 0; i < 5; i++ {
+		assert.Equal("canary hello jack", callGreet())
+	}
+
+	// sticky by the hash key
+	_, err = c.Call(rootCtx, jsoff.NewRequestMessage(3, "rpcmux.split", []interface{}{
+		"greet", map[string]interface{}{"canary": 1, "stable": 1}}))
+	assert.Nil(err)
+	c.SetExtraHeader(http.Header{"X-Rpcmux-Hash-Key": []string{"user1"}})
+	first := callGreet()
+	for i := 0; i < 10; i++ {
+		assert.Equal(first, callGreet())
+	}
+}
+
+func TestWorkerShadow(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Methods = map[string]*app.MethodConfig{
+		"greet": {Shadow: &app.ShadowConfig{Fraction: 1}},
+	}
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16161", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	worker1 := NewServiceWorker([]string{"h2c://127.0.0.1:16161"})
+	worker1.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	go worker1.ConnectWait(workerCtx)
+
+	// the shadow worker is slow and replies differently to some names
+	var shadowCalls int32
+	worker2 := NewServiceWorker([]string{"h2c://127.0.0.1:16161"})
+	worker2.Actor.OnTyped("greet", func(name string) (string, error) {
+		atomic.AddInt32(&shadowCalls, 1)
+		time.Sleep(100 * time.Millisecond)
+		if name == "rose" {
+			return "hi " + name, nil
+		}
+		return "hello " + name, nil
+	})
+	worker2.SetLabel("track", "shadow")
+	go worker2.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16161")
+	assert.Nil(err)
+
+	for _, name := range []string{"jack", "rose", "jack"} {
+		start := time.Now()
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "greet", []interface{}{name}))
+		assert.Nil(err)
+		// the primary response is not delayed by the shadow one
+		assert.True(time.Since(start) < 80*time.Millisecond)
+		assert.Equal("hello "+name, resmsg.MustResult())
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(int32(3), atomic.LoadInt32(&shadowCalls))
+
+	metrics := map[string]map[string]int{}
+	err = c.UnwrapCall(rootCtx, jsoff.NewRequestMessage(2, "rpcmux.metrics", nil), &metrics)
+	assert.Nil(err)
+	assert.Equal(map[string]int{"greet": 3}, metrics["shadow_requests"])
+	assert.Equal(map[string]int{"greet": 1}, metrics["shadow_mismatches"])
+}
+
+func TestWorkerSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Methods = map[string]*app.MethodConfig{
+		"greetEu": {Selector: "zone=eu"},
+	}
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16171", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	for _, zone := range []string{"eu", "us"} {
+		reply := zone + " hello "
+		w := NewServiceWorker([]string{"h2c://127.0.0.1:16171"})
+		w.Actor.OnTyped("greet", func(name string) (string, error) {
+			return reply + name, nil
+		})
+		w.Actor.OnTyped("greetEu", func(name string) (string, error) {
+			return reply + name, nil
+		})
+		w.SetMetadata(ServiceMetadata{Zone: zone, Weight: 2})
+		go w.ConnectWait(workerCtx)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16171")
+	assert.Nil(err)
+
+	callGreet := func(method string) jsoff.Message {
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, method, []interface{}{"jack"}))
+		assert.Nil(err)
+		return resmsg
+	}
+
+	// the configured selector
+	for i := 0; i < 5; i++ {
+		assert.Equal("eu hello jack", callGreet("greetEu").MustResult())
+	}
+
+	// the selector asked by the caller
+	c.SetExtraHeader(http.Header{"X-Rpcmux-Selector": []string{"zone=us"}})
+	for i := 0; i < 5; i++ {
+		assert.Equal("us hello jack", callGreet("greet").MustResult())
+	}
+
+	// both selectors must match
+	resmsg := callGreet("greetEu")
+	assert.True(resmsg.IsError())
+	assert.Equal(jsoff.ErrMethodNotFound.Code, resmsg.MustError().Code)
+
+	c.SetExtraHeader(http.Header{"X-Rpcmux-Selector": []string{"=us"}})
+	resmsg = callGreet("greet")
+	assert.True(resmsg.IsError())
+	assert.Equal(-32602, resmsg.MustError().Code)
+}
+
+func TestWorkerRedeclare(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16181", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16181"})
+	worker.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	worker.SetTimeout("bye", time.Second)
+	go worker.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16181")
+	assert.Nil(err)
+
+	call := func(method string) jsoff.Message {
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, method, []interface{}{"jack"}))
+		assert.Nil(err)
+		return resmsg
+	}
+	assert.Equal("hello jack", call("greet").MustResult())
+	assert.True(call("bye").IsError())
+
+	// handlers changed after connecting, concurrent with requests
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			call("greet")
+		}
+	}()
+	err = worker.AddTypedHandler(rootCtx, "bye", func(name string) (string, error) {
+		return "bye " + name, nil
+	})
+	assert.Nil(err)
+	err = worker.RemoveHandler(rootCtx, "greet")
+	assert.Nil(err)
+	<-done
+
+	assert.Equal("bye jack", call("bye").MustResult())
+	resmsg := call("greet")
+	assert.True(resmsg.IsError())
+	assert.Equal(jsoff.ErrMethodNotFound.Code, resmsg.MustError().Code)
+}
+
+func TestWorkerWaitForService(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Methods = map[string]*app.MethodConfig{
+		"greet": {WaitForService: time.Second},
+		"bye":   {WaitForService: 200 * time.Millisecond},
+	}
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16191", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	// the worker declares after the request arrives
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		worker := NewServiceWorker([]string{"h2c://127.0.0.1:16191"})
+		worker.Actor.OnTyped("greet", func(name string) (string, error) {
+			return "hello " + name, nil
+		})
+		worker.ConnectWait(workerCtx)
+	}()
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16191")
+	assert.Nil(err)
+
+	start := time.Now()
+	resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "greet", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.Equal("hello jack", resmsg.MustResult())
+	assert.True(time.Since(start) < time.Second)
+
+	resmsg, err = c.Call(rootCtx, jsoff.NewRequestMessage(2, "bye", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.True(resmsg.IsError())
+	assert.Equal(app.ErrNoProvider.Code, resmsg.MustError().Code)
+
+	// methods without a grace period fail at once
+	resmsg, err = c.Call(rootCtx, jsoff.NewRequestMessage(3, "hello", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.Equal(jsoff.ErrMethodNotFound.Code, resmsg.MustError().Code)
+}
+
+func TestWorkerCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16201", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	var cancelled int32
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16201"})
+	worker.Actor.OnTypedContext("slow", func(ctx context.Context, name string) (string, error) {
+		select {
+		case <-ctx.Done():
+			atomic.AddInt32(&cancelled, 1)
+			return "", ctx.Err()
+		case <-time.After(2 * time.Second):
+			return "hello " + name, nil
+		}
+	})
+	worker.SetTimeout("slow", 200*time.Millisecond)
+	go worker.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16201")
+	assert.Nil(err)
+
+	// the request expires
+	resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "slow", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.Equal(jsoff.ErrTimeout.Code, resmsg.MustError().Code)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&cancelled))
+
+	// the caller gives up
+	callCtx, cancelCall := context.WithTimeout(rootCtx, 50*time.Millisecond)
+	defer cancelCall()
+	_, err = c.Call(callCtx, jsoff.NewRequestMessage(2, "slow", []interface{}{"jack"}))
+	assert.NotNil(err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(int32(2), atomic.LoadInt32(&cancelled))
+}
+
+func TestWorkerKeepalive(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Router.Keepalive = app.KeepaliveConfig{
+		Interval:  100 * time.Millisecond,
+		Timeout:   50 * time.Millisecond,
+		MaxMissed: 2,
+	}
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16211", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	worker1 := NewServiceWorker([]string{"h2c://127.0.0.1:16211"})
+	worker1.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	go worker1.ConnectWait(workerCtx)
+
+	// a stalled worker
+	var stalled int32 = 1
+	var connects int32
+	worker2 := NewServiceWorker([]string{"h2c://127.0.0.1:16211"})
+	worker2.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	worker2.Actor.Off("_ping")
+	worker2.Actor.On("_ping", func(params []interface{}) (interface{}, error) {
+		if atomic.LoadInt32(&stalled) != 0 {
+			time.Sleep(time.Second)
+		}
+		return "pong", nil
+	})
+	worker2.OnStateChange(func(serverUrl string, state ConnState) {
+		if state == StateConnected {
+			atomic.AddInt32(&connects, 1)
+		}
+	})
+	go worker2.ConnectWait(workerCtx)
+	time.Sleep(600 * time.Millisecond)
+
+	// dismissed and reconnected
+	assert.True(atomic.LoadInt32(&connects) >= 2)
+
+	// served again once the stall ends
+	atomic.StoreInt32(&stalled, 0)
+	time.Sleep(500 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16211")
+	assert.Nil(err)
+
+	var services []struct {
+		Methods []string
+		Rtt     float64
+	}
+	err = c.UnwrapCall(rootCtx, jsoff.NewRequestMessage(1, "rpcmux.services", nil), &services)
+	assert.Nil(err)
+	assert.Equal(2, len(services))
+	for _, srv := range services {
+		assert.True(srv.Rtt > 0)
+	}
+
+	for i := 0; i < 5; i++ {
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(2, "greet", []interface{}{"jack"}))
+		assert.Nil(err)
+		assert.Equal("hello jack", resmsg.MustResult())
+	}
+}
+
+func TestWorkerDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+
+	actor := app.NewActor(app1)
+	_ = app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16221", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	worker1 := NewServiceWorker([]string{"h2c://127.0.0.1:16221"})
+	worker1.Actor.OnTyped("greet", func(name string) (string, error) {
+		time.Sleep(300 * time.Millisecond)
+		return "slow hello " + name, nil
+	})
+	go worker1.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16221")
+	assert.Nil(err)
+
+	// a request in flight on worker1
+	slowres := make(chan jsoff.Message, 1)
+	go func() {
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "greet", []interface{}{"jack"}))
+		assert.Nil(err)
+		slowres <- resmsg
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	worker2 := NewServiceWorker([]string{"h2c://127.0.0.1:16221"})
+	worker2.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	go worker2.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	drained := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		drained <- worker1.Drain(rootCtx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// new requests go to worker2 only
+	for i := 0; i < 5; i++ {
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(2, "greet", []interface{}{"rose"}))
+		assert.Nil(err)
+		assert.Equal("hello rose", resmsg.MustResult())
+	}
+
+	assert.Nil(<-drained)
+	assert.True(time.Since(start) >= 100*time.Millisecond)
+	assert.Equal("slow hello jack", (<-slowres).MustResult())
+}
+
+func TestWorkerReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	startServer := func() *app.App {
+		a := app.NewApp()
+		actor := app.NewActor(a)
+		_ = a.GetRouter("default")
+		var handler http.Handler
+		handler = jsoffnet.NewGatewayHandler(a.Context(), actor, true)
+		go jsoffnet.ListenAndServe(a.Context(), "127.0.0.1:16231", handler)
+		time.Sleep(100 * time.Millisecond)
+		return a
+	}
+	app1 := startServer()
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	var connected int32
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16231"})
+	worker.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	worker.OnStateChange(func(serverUrl string, state ConnState) {
+		if state == StateConnected {
+			atomic.AddInt32(&connected, 1)
+		}
+	})
+	go worker.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&connected))
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16231")
+	assert.Nil(err)
+	resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "greet", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.Equal("hello jack", resmsg.MustResult())
+
+	// the server restarts
+	app1.Stop()
+	time.Sleep(100 * time.Millisecond)
+	app2 := startServer()
+	defer app2.Stop()
+	time.Sleep(time.Second)
+
+	assert.Equal(int32(2), atomic.LoadInt32(&connected))
+	c, err = jsoffnet.NewClient("http://127.0.0.1:16231")
+	assert.Nil(err)
+	resmsg, err = c.Call(rootCtx, jsoff.NewRequestMessage(2, "greet", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.Equal("hello jack", resmsg.MustResult())
+}
+
+func TestWorkerAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+	app1.Config.Server.Auth = &jsoffnet.AuthConfig{
+		Basic: []jsoffnet.BasicAuthConfig{
+			{Username: "tenant1", Password: "pwd1", Settings: map[string]interface{}{"namespace": "tenant1"}},
+		},
+		Bearer: []jsoffnet.BearerAuthConfig{
+			{Token: "token2", Username: "tenant2", Settings: map[string]interface{}{"namespace": "tenant2"}},
+		},
+	}
+
+	actor := app.NewActor(app1)
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	handler = jsoffnet.NewAuthHandler(app1.Config.Server.Auth, handler)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16241", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	// the h2c preface carries no headers, so workers with
+	// credentials connect by websocket
+	worker1 := NewServiceWorker([]string{"ws://127.0.0.1:16241"})
+	worker1.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "tenant1 hello " + name, nil
+	})
+	assert.Nil(worker1.SetBasicAuth("tenant1", "pwd1"))
+	go worker1.ConnectWait(workerCtx)
+
+	worker2 := NewServiceWorker([]string{"ws://127.0.0.1:16241"})
+	worker2.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "tenant2 hello " + name, nil
+	})
+	assert.Nil(worker2.SetBearerToken("token2"))
+	go worker2.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	call := func(h http.Header) jsoff.Message {
+		c, err := jsoffnet.NewClient("http://127.0.0.1:16241")
+		assert.Nil(err)
+		c.SetExtraHeader(h)
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(1, "greet", []interface{}{"jack"}))
+		assert.Nil(err)
+		return resmsg
+	}
+
+	h1 := http.Header{}
+	h1.Set("Authorization", "Basic dGVuYW50MTpwd2Qx")
+	assert.Equal("tenant1 hello jack", call(h1).MustResult())
+
+	h2 := http.Header{}
+	h2.Set("Authorization", "Bearer token2")
+	assert.Equal("tenant2 hello jack", call(h2).MustResult())
+
+	// the client cert files must exist
+	assert.NotNil(worker1.SetClientCert("nonexist.crt", "nonexist.key", ""))
+
+	// credentials are never dropped silently on h2c
+	worker3 := NewServiceWorker([]string{"ws://127.0.0.1:16241", "h2c://127.0.0.1:16241"})
+	assert.NotNil(worker3.SetBasicAuth("tenant1", "pwd1"))
+	assert.NotNil(worker3.SetBearerToken("token2"))
+	assert.NotNil(worker3.SetClientCert("nonexist.crt", "nonexist.key", ""))
+}
+
+func TestWorkerAuthReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx := context.Background()
+
+	startServer := func() *app.App {
+		a := app.NewApp()
+		a.Config.Server.Auth = &jsoffnet.AuthConfig{
+			Basic: []jsoffnet.BasicAuthConfig{
+				{Username: "tenant1", Password: "pwd1", Settings: map[string]interface{}{"namespace": "tenant1"}},
+			},
+		}
+		actor := app.NewActor(a)
+		var handler http.Handler
+		handler = jsoffnet.NewGatewayHandler(a.Context(), actor, true)
+		handler = jsoffnet.NewAuthHandler(a.Config.Server.Auth, handler)
+		go jsoffnet.ListenAndServe(a.Context(), "127.0.0.1:16261", handler)
+		time.Sleep(100 * time.Millisecond)
+		return a
+	}
+	app1 := startServer()
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	var connected int32
+	worker := NewServiceWorker([]string{"ws://127.0.0.1:16261"})
+	worker.Actor.OnTyped("greet", func(name string) (string, error) {
+		return "tenant1 hello " + name, nil
+	})
+	assert.Nil(worker.SetBasicAuth("tenant1", "pwd1"))
+	worker.OnStateChange(func(serverUrl string, state ConnState) {
+		if state == StateConnected {
+			atomic.AddInt32(&connected, 1)
+		}
+	})
+	go worker.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&connected))
+
+	call := func(id int) jsoff.Message {
+		c, err := jsoffnet.NewClient("http://127.0.0.1:16261")
+		assert.Nil(err)
+		h := http.Header{}
+		h.Set("Authorization", "Basic dGVuYW50MTpwd2Qx")
+		c.SetExtraHeader(h)
+		resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(id, "greet", []interface{}{"jack"}))
+		assert.Nil(err)
+		return resmsg
+	}
+	assert.Equal("tenant1 hello jack", call(1).MustResult())
+
+	// the server restarts, the replaced client keeps the credentials
+	app1.Stop()
+	time.Sleep(100 * time.Millisecond)
+	app2 := startServer()
+	defer app2.Stop()
+	time.Sleep(time.Second)
+
+	assert.Equal(int32(2), atomic.LoadInt32(&connected))
+	assert.Equal("tenant1 hello jack", call(2).MustResult())
+}
+
+func TestWorkerConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	// the servers retry the rejected requests by the code
+	assert.Equal(app.ErrWorkerBusy.Code, ErrWorkerBusy.Code)
+
+	rootCtx := context.Background()
+
+	app1 := app.NewApp()
+	defer app1.Stop()
+
+	actor := app.NewActor(app1)
+	router := app1.GetRouter("default")
+	var handler http.Handler
+	handler = jsoffnet.NewGatewayHandler(app1.Context(), actor, true)
+	go jsoffnet.ListenAndServe(app1.Context(), "127.0.0.1:16251", handler)
+	time.Sleep(100 * time.Millisecond)
+
+	workerCtx, cancelWorkers := context.WithCancel(rootCtx)
+	defer cancelWorkers()
+
+	var running, maxRunning int32
+	worker := NewServiceWorker([]string{"h2c://127.0.0.1:16251"})
+	worker.Actor.OnTyped("slow", func(name string) (string, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		if n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+		time.Sleep(200 * time.Millisecond)
+		return "hello " + name, nil
+	})
+	worker.Actor.OnTyped("fast", func(name string) (string, error) {
+		return "hi " + name, nil
+	})
+	worker.SetConcurrency(2, 1)
+	worker.SetMethodConcurrency("slow", 1)
+	go worker.ConnectWait(workerCtx)
+	time.Sleep(100 * time.Millisecond)
+
+	infos := router.ServicesInfo()
+	assert.Equal(1, len(infos))
+	assert.Equal(3, infos[0]["capacity"])
+
+	c, err := jsoffnet.NewClient("http://127.0.0.1:16251")
+	assert.Nil(err)
+
+	// one slow request runs, one waits and the other is rejected
+	results := make(chan jsoff.Message, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(i, "slow", []interface{}{"jack"}))
+			assert.Nil(err)
+			results <- resmsg
+		}(i)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// the waiting slow request holds no worker slot
+	resmsg, err := c.Call(rootCtx, jsoff.NewRequestMessage(10, "fast", []interface{}{"jack"}))
+	assert.Nil(err)
+	assert.Equal("hi jack", resmsg.MustResult())
+
+	busy := 0
+	for i := 0; i < 3; i++ {
+		resmsg := <-results
+		if resmsg.IsError() {
+			assert.Equal(ErrWorkerBusy.Code, resmsg.MustError().Code)
+			busy++
+		} else {
+			assert.Equal("hello jack", resmsg.MustResult())
+		}
+	}
+	assert.Equal(1, busy)
+	assert.Equal(int32(1), atomic.LoadInt32(&maxRunning))
+}